@@ -15,6 +15,9 @@ type Config struct {
 	User           string
 	Pass           string
 	HostHeader     string
+	DialAddress    string
+	ServerName     string
+	ALPN           []string
 	Incognito      bool
 
 	Whitelist []string
@@ -31,6 +34,76 @@ type Config struct {
 	SSLCrt string
 
 	RedirectGateway string
+
+	BatchSize  int
+	BatchDelay int
+	Compress   string
+
+	Proxy       string
+	Obfuscation string
+
+	TunnelPath  string
+	VersionPath string
+	AuthHeader  string
+	Decoy       string
+
+	PathPrefix     string
+	TrustedProxies []string
+	ProxyProtocol  bool
+
+	Listeners []struct {
+		Address       string
+		SSL           bool
+		SSLKey        string
+		SSLCrt        string
+		ProxyProtocol bool
+		Certificates  []struct {
+			SSLKey string
+			SSLCrt string
+		}
+		Transports []string
+	}
+
+	ResumeTimeout int
+
+	Servers         []Server
+	ServerSelection string
+	Region          string
+	RecheckInterval int
+
+	RetryMin   int
+	RetryMax   int
+	MaxRetries int
+
+	MissedPongs int
+
+	DrainTimeout     int
+	ShutdownRedirect string
+
+	MSS int
+
+	StateFile string
+	DryRun    bool
+
+	Domains     []string
+	DomainTTL   int
+	DNSListen   string
+	DNSUpstream string
+
+	DNS          []string
+	DNSIntercept bool
+
+	KillSwitch bool
+
+	NAT          bool
+	NATInterface string
+}
+
+type Server struct {
+	Address     string
+	DialAddress string
+	Weight      int
+	Region      string
 }
 
 func Load(path string) (Config, error) {
@@ -47,8 +120,56 @@ func Load(path string) (Config, error) {
 		config.MTU = 1500
 	}
 
-	if config.RedirectGateway == "" {
-		config.RedirectGateway = "0.0.0.0/0"
+	if config.BatchDelay <= 0 {
+		config.BatchDelay = 2
+	}
+
+	if config.ResumeTimeout <= 0 {
+		config.ResumeTimeout = 60
+	}
+
+	if config.ServerSelection == "" {
+		config.ServerSelection = "order"
+	}
+
+	if config.RecheckInterval <= 0 {
+		config.RecheckInterval = 300
+	}
+
+	if config.RetryMin <= 0 {
+		config.RetryMin = 1
+	}
+
+	if config.RetryMax <= 0 {
+		config.RetryMax = 60
+	}
+
+	if config.MissedPongs <= 0 {
+		config.MissedPongs = 3
+	}
+
+	if config.DrainTimeout <= 0 {
+		config.DrainTimeout = 10
+	}
+
+	if config.DomainTTL <= 0 {
+		config.DomainTTL = 300
+	}
+
+	if config.DNSListen == "" {
+		config.DNSListen = "127.0.0.1:53"
+	}
+
+	if config.TunnelPath == "" {
+		config.TunnelPath = "/home"
+	}
+
+	if config.VersionPath == "" {
+		config.VersionPath = "/version"
+	}
+
+	if config.AuthHeader == "" {
+		config.AuthHeader = "Cookie"
 	}
 
 	return config, nil
@@ -2,10 +2,10 @@ package main
 
 import (
 	"flag"
+	"net"
 	"os"
 	"prousf/config"
 	"prousf/log"
-	"prousf/utils"
 	"prousf/vpn"
 	"runtime"
 	"time"
@@ -35,6 +35,8 @@ func main() {
 	}
 
 	var usersAuthen []vpn.User
+	var listeners []vpn.Listener
+	var servers []vpn.Server
 	if ServerMode {
 		for _, u := range conf.Users {
 			usersAuthen = append(usersAuthen, vpn.User{
@@ -43,15 +45,57 @@ func main() {
 				Pass: u.Password,
 			})
 		}
+
+		for _, l := range conf.Listeners {
+			listener := vpn.Listener{
+				Address:       l.Address,
+				SSL:           l.SSL,
+				SSLCrt:        l.SSLCrt,
+				SSLKey:        l.SSLKey,
+				ProxyProtocol: l.ProxyProtocol,
+				Transports:    l.Transports,
+			}
+			for _, c := range l.Certificates {
+				listener.Certificates = append(listener.Certificates, vpn.Certificate{
+					SSLCrt: c.SSLCrt,
+					SSLKey: c.SSLKey,
+				})
+			}
+			listeners = append(listeners, listener)
+		}
 	} else {
-		newDomain, newHost, err := utils.ValidServer(conf.Server)
-		if err != nil {
-			log.Error(err)
-			os.Exit(1)
+		if len(conf.Servers) < 1 {
+			conf.Servers = append(conf.Servers, config.Server{
+				Address:     conf.Server,
+				DialAddress: conf.DialAddress,
+			})
 		}
-		conf.Server = newHost
-		if len(conf.HostHeader) < 1 {
-			conf.HostHeader = newDomain
+
+		for _, s := range conf.Servers {
+			dialAddress := s.Address
+			if len(s.DialAddress) > 0 {
+				dialAddress = s.DialAddress
+			}
+			// resolved on every connection attempt
+			if _, _, err := net.SplitHostPort(dialAddress); err != nil {
+				log.Error("invalid server", dialAddress+":", err)
+				continue
+			}
+			newDomain := s.Address
+			if host, _, err := net.SplitHostPort(s.Address); err == nil {
+				newDomain = host
+			}
+			servers = append(servers, vpn.Server{
+				Address: dialAddress,
+				Domain:  newDomain,
+				Weight:  s.Weight,
+				Region:  s.Region,
+			})
+		}
+
+		if len(servers) < 1 {
+			log.Error("no server available")
+			os.Exit(1)
 		}
 		usersAuthen = append(usersAuthen, vpn.User{
 			Name: conf.User,
@@ -63,6 +107,8 @@ func main() {
 		MTU:             conf.MTU,
 		TTL:             time.Duration(conf.TTL) * time.Second,
 		ServerAddr:      conf.Server,
+		ServerName:      conf.ServerName,
+		ALPN:            conf.ALPN,
 		LocalAddr:       conf.Address,
 		HostHeader:      conf.HostHeader,
 		DefaultGateway:  conf.DefaultGateway,
@@ -74,9 +120,52 @@ func main() {
 		SSLKey:          conf.SSLKey,
 		SSLCrt:          conf.SSLCrt,
 		RedirectGateway: conf.RedirectGateway,
+		BatchSize:       conf.BatchSize,
+		BatchDelay:      time.Duration(conf.BatchDelay) * time.Millisecond,
+		Compress:        conf.Compress,
+		Proxy:           conf.Proxy,
+		Obfuscation:     conf.Obfuscation,
+		TunnelPath:      conf.TunnelPath,
+		VersionPath:     conf.VersionPath,
+		AuthHeader:      conf.AuthHeader,
+		Decoy:           conf.Decoy,
+		PathPrefix:      conf.PathPrefix,
+		TrustedProxies:  conf.TrustedProxies,
+		ProxyProtocol:   conf.ProxyProtocol,
+		Listeners:       listeners,
+		ResumeTimeout:   time.Duration(conf.ResumeTimeout) * time.Second,
+		Servers:         servers,
+		ServerSelection: conf.ServerSelection,
+		Region:          conf.Region,
+		RecheckInterval: time.Duration(conf.RecheckInterval) * time.Second,
+		RetryMin:        time.Duration(conf.RetryMin) * time.Second,
+		RetryMax:        time.Duration(conf.RetryMax) * time.Second,
+		MaxRetries:      conf.MaxRetries,
+		MissedPongs:     conf.MissedPongs,
+
+		DrainTimeout:     time.Duration(conf.DrainTimeout) * time.Second,
+		ShutdownRedirect: conf.ShutdownRedirect,
+
+		MSS:       conf.MSS,
+		StateFile: conf.StateFile,
+		DryRun:    conf.DryRun,
+
+		Domains:     conf.Domains,
+		DomainTTL:   time.Duration(conf.DomainTTL) * time.Second,
+		DNSListen:   conf.DNSListen,
+		DNSUpstream: conf.DNSUpstream,
+
+		DNS:          conf.DNS,
+		DNSIntercept: conf.DNSIntercept,
+
+		KillSwitch: conf.KillSwitch,
+
+		NAT:          conf.NAT,
+		NATInterface: conf.NATInterface,
 	})
 	if err != nil {
 		log.Error("Cannot start tunnel vpn:", err)
+		os.Exit(1)
 	}
 
 }
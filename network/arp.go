@@ -1,13 +1,20 @@
 package network
 
 import (
+	"bytes"
 	"prousf/log"
 	"sync"
+	"time"
 )
 
 type ARPRecord struct {
-	Conn chan []byte
-	Key  []byte
+	Conn   chan []byte
+	Key    []byte
+	Ticket string
+	// held by the connection sending Conn, the next one waits for it
+	Writer *sync.Mutex
+
+	expire *time.Timer // set while no connection is attached
 }
 
 type ARP struct {
@@ -21,7 +28,7 @@ func NewARP() (arp *ARP) {
 	return
 }
 
-func (arp *ARP) QueryOne(ip string) (ARPRecord, bool) {
+func (arp *ARP) QueryOne() (ARPRecord, bool) {
 	arp.mu.Lock()
 	defer arp.mu.Unlock()
 	for _, v := range arp.Table {
@@ -51,6 +58,10 @@ func (arp *ARP) Delete(id string) {
 	}
 	arp.mu.Lock()
 	defer arp.mu.Unlock()
+	arp.delete(id)
+}
+
+func (arp *ARP) delete(id string) {
 	current, found := arp.Table[id]
 	if found {
 		log.Debug("arptable delete", id)
@@ -58,11 +69,65 @@ func (arp *ARP) Delete(id string) {
 		if len(current.Conn) > 1 {
 			<-current.Conn
 		}
+		if current.expire != nil {
+			current.expire.Stop()
+		}
 		close(current.Conn)
 	}
 }
 
-func (arp *ARP) Update(id string, key []byte) (ARPRecord, bool) {
+// Detach keeps the record of a dropped connection for timeout so the
+// client can resume it, packets for it keep queueing in Conn meanwhile.
+func (arp *ARP) Detach(id string, timeout time.Duration) {
+	arp.mu.Lock()
+	defer arp.mu.Unlock()
+	current, found := arp.Table[id]
+	if !found {
+		return
+	}
+
+	if current.expire != nil {
+		current.expire.Stop()
+	}
+
+	var expire *time.Timer
+	expire = time.AfterFunc(timeout, func() {
+		arp.mu.Lock()
+		defer arp.mu.Unlock()
+		if arp.Table[id].expire == expire {
+			log.Debug("arptable expire", id)
+			arp.delete(id)
+		}
+	})
+	current.expire = expire
+	arp.Table[id] = current
+}
+
+// Resume returns the record of id if the client presents the same ticket
+// and key it was created with.
+func (arp *ARP) Resume(id string, key []byte, ticket string) (ARPRecord, bool) {
+	arp.mu.Lock()
+	defer arp.mu.Unlock()
+	current, found := arp.Table[id]
+	if !found || len(ticket) < 1 || current.Ticket != ticket || !bytes.Equal(current.Key, key) {
+		return ARPRecord{}, false
+	}
+	return current, true
+}
+
+// Attach cancels the expiry started by Detach.
+func (arp *ARP) Attach(id string) {
+	arp.mu.Lock()
+	defer arp.mu.Unlock()
+	current, found := arp.Table[id]
+	if found && current.expire != nil {
+		current.expire.Stop()
+		current.expire = nil
+		arp.Table[id] = current
+	}
+}
+
+func (arp *ARP) Update(id string, key []byte, ticket string) (ARPRecord, bool) {
 	arp.mu.Lock()
 	defer arp.mu.Unlock()
 	_, found := arp.Table[id]
@@ -72,7 +137,7 @@ func (arp *ARP) Update(id string, key []byte) (ARPRecord, bool) {
 		return ARPRecord{}, found
 	}
 	conn := make(chan []byte, 100)
-	newData := ARPRecord{conn, key}
+	newData := ARPRecord{Conn: conn, Key: key, Ticket: ticket, Writer: new(sync.Mutex)}
 	arp.Table[id] = newData
 	listClient := []string{}
 	for c, _ := range arp.Table {
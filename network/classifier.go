@@ -0,0 +1,130 @@
+package network
+
+import (
+	"net"
+	"sync"
+)
+
+// Class is what to do with a packet to an address.
+type Class uint8
+
+const (
+	CLASS_NONE Class = iota
+	CLASS_TUNNEL
+	CLASS_BYPASS
+	CLASS_BLOCK
+)
+
+// Classifier finds the class of the longest prefix an address falls in,
+// like the kernel picks a route. It is a binary trie per family, a lookup
+// walks at most 32 or 128 nodes and does not allocate.
+type Classifier struct {
+	mu sync.RWMutex
+	v4 *trieNode
+	v6 *trieNode
+}
+
+type trieNode struct {
+	child [2]*trieNode
+	class Class
+	set   bool
+}
+
+func NewClassifier() *Classifier {
+	return &Classifier{v4: new(trieNode), v6: new(trieNode)}
+}
+
+// Insert sets the class of prefix, a CIDR or a single ip, replacing the
+// class it had.
+func (c *Classifier) Insert(prefix string, class Class) error {
+	p, err := ParsePrefix(prefix)
+	if err != nil {
+		return err
+	}
+	ones, _ := p.Mask.Size()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ip := c.root(p.IP)
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if n.child[b] == nil {
+			n.child[b] = new(trieNode)
+		}
+		n = n.child[b]
+	}
+	n.class = class
+	n.set = true
+	return nil
+}
+
+// Delete removes prefix, the addresses in it fall back to the class of
+// the next shorter prefix.
+func (c *Classifier) Delete(prefix string) error {
+	p, err := ParsePrefix(prefix)
+	if err != nil {
+		return err
+	}
+	ones, _ := p.Mask.Size()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var path [129]*trieNode
+	n, ip := c.root(p.IP)
+	path[0] = n
+	for i := 0; i < ones; i++ {
+		n = n.child[bit(ip, i)]
+		if n == nil {
+			return nil
+		}
+		path[i+1] = n
+	}
+	n.set = false
+
+	// drop the nodes left without a class or children
+	for i := ones; i > 0; i-- {
+		n = path[i]
+		if n.set || n.child[0] != nil || n.child[1] != nil {
+			break
+		}
+		path[i-1].child[bit(ip, i-1)] = nil
+	}
+	return nil
+}
+
+// Lookup returns the class of the longest prefix containing ip,
+// CLASS_NONE when there is none.
+func (c *Classifier) Lookup(ip net.IP) Class {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	n, ip := c.root(ip)
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return CLASS_NONE
+	}
+
+	class := CLASS_NONE
+	if n.set {
+		class = n.class
+	}
+	for i := 0; i < len(ip)*8; i++ {
+		n = n.child[bit(ip, i)]
+		if n == nil {
+			break
+		}
+		if n.set {
+			class = n.class
+		}
+	}
+	return class
+}
+
+func (c *Classifier) root(ip net.IP) (*trieNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return c.v4, ip4
+	}
+	return c.v6, ip
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-i%8)) & 1
+}
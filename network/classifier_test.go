@@ -0,0 +1,102 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClassifierLookup(t *testing.T) {
+	c := NewClassifier()
+	for prefix, class := range map[string]Class{
+		"0.0.0.0/1":     CLASS_TUNNEL,
+		"128.0.0.0/1":   CLASS_TUNNEL,
+		"10.0.0.0/8":    CLASS_BYPASS,
+		"10.1.0.0/16":   CLASS_TUNNEL,
+		"10.1.2.3":      CLASS_BLOCK,
+		"::/1":          CLASS_TUNNEL,
+		"2001:db8::/32": CLASS_BYPASS,
+	} {
+		err := c.Insert(prefix, class)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for ip, want := range map[string]Class{
+		"8.8.8.8":         CLASS_TUNNEL,
+		"200.1.1.1":       CLASS_TUNNEL,
+		"10.2.0.1":        CLASS_BYPASS,
+		"10.1.9.9":        CLASS_TUNNEL,
+		"10.1.2.3":        CLASS_BLOCK,
+		"10.1.2.4":        CLASS_TUNNEL,
+		"::ffff:10.1.2.3": CLASS_BLOCK,
+		"2001:db8::1":     CLASS_BYPASS,
+		"2001:db9::1":     CLASS_TUNNEL,
+		"8000::1":         CLASS_NONE,
+		"fe80::1":         CLASS_NONE,
+	} {
+		if got := c.Lookup(net.ParseIP(ip)); got != want {
+			t.Errorf("Lookup(%s) = %d, want %d", ip, got, want)
+		}
+	}
+	if got := c.Lookup(nil); got != CLASS_NONE {
+		t.Errorf("Lookup(nil) = %d", got)
+	}
+}
+
+func TestClassifierDelete(t *testing.T) {
+	c := NewClassifier()
+	c.Insert("10.0.0.0/8", CLASS_BYPASS)
+	c.Insert("10.1.0.0/16", CLASS_TUNNEL)
+	c.Insert("10.1.2.3", CLASS_BLOCK)
+
+	// the next shorter prefix takes over
+	c.Delete("10.1.2.3")
+	if got := c.Lookup(net.ParseIP("10.1.2.3")); got != CLASS_TUNNEL {
+		t.Errorf("after delete /32: %d, want %d", got, CLASS_TUNNEL)
+	}
+	c.Delete("10.1.0.0/16")
+	if got := c.Lookup(net.ParseIP("10.1.2.3")); got != CLASS_BYPASS {
+		t.Errorf("after delete /16: %d, want %d", got, CLASS_BYPASS)
+	}
+
+	// deleting a missing prefix, or one only on the path, changes nothing
+	c.Delete("172.16.0.0/12")
+	c.Delete("10.0.0.0/7")
+	if got := c.Lookup(net.ParseIP("10.9.9.9")); got != CLASS_BYPASS {
+		t.Errorf("after delete of missing prefixes: %d, want %d", got, CLASS_BYPASS)
+	}
+
+	// the emptied branch is pruned
+	c.Delete("10.0.0.0/8")
+	if c.v4.child[0] != nil || c.v4.child[1] != nil {
+		t.Errorf("nodes left after deleting every prefix")
+	}
+	if err := c.Delete("10.0.0.0/33"); err == nil {
+		t.Errorf("Delete of an invalid prefix: no error")
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	c := NewClassifier()
+	c.Insert("0.0.0.0/1", CLASS_TUNNEL)
+	c.Insert("128.0.0.0/1", CLASS_TUNNEL)
+	c.Insert("::/1", CLASS_TUNNEL)
+	c.Insert("8000::/1", CLASS_TUNNEL)
+	for i := 0; i < 1000; i++ {
+		c.Insert(net.IPv4(10, byte(i>>8), byte(i), 0).String()+"/24", CLASS_BYPASS)
+	}
+	c.Insert("10.0.1.1", CLASS_BLOCK)
+
+	ips := []net.IP{
+		net.ParseIP("10.0.1.1").To4(),
+		net.ParseIP("10.3.200.7").To4(),
+		net.ParseIP("8.8.8.8").To4(),
+		net.ParseIP("2001:db8::1"),
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Lookup(ips[i%len(ips)])
+	}
+}
@@ -0,0 +1,125 @@
+package network
+
+import (
+	"encoding/binary"
+)
+
+const (
+	IPV4_HEADER_LEN = 20
+	IPV6_HEADER_LEN = 40
+	TCP_HEADER_LEN  = 20
+
+	PROTOCOL_TCP = 6
+	PROTOCOL_UDP = 17
+
+	TCP_FLAG_SYN   = 0x02
+	TCP_OPTION_END = 0
+	TCP_OPTION_NOP = 1
+	TCP_OPTION_MSS = 2
+)
+
+// MSSForMTU is the largest TCP segment over IPv4 that fits an IP packet
+// of mtu bytes. It only protects a tun MTU below the 1500 of the peers: the
+// tunnel is a TCP stream, its overhead never splits an inner packet.
+func MSSForMTU(mtu int) int {
+	return mtu - IPV4_HEADER_LEN - TCP_HEADER_LEN
+}
+
+// ClampMSS lowers the MSS option of a TCP SYN or SYN-ACK to at most mss
+// (less the longer header for IPv6) and fixes the TCP checksum. The packet
+// is changed in place, it returns true when it was.
+func ClampMSS(packet []byte, mss int) bool {
+	if len(packet) < 1 {
+		return false
+	}
+
+	var tcp []byte
+	isIPv6 := false
+	switch packet[0] & 0xF0 {
+	case 0x40:
+		if len(packet) < IPV4_HEADER_LEN || packet[9] != PROTOCOL_TCP {
+			return false
+		}
+		// only the first fragment has the TCP header
+		if binary.BigEndian.Uint16(packet[6:8])&0x1FFF != 0 {
+			return false
+		}
+		ihl := int(packet[0]&0x0F) * 4
+		if ihl < IPV4_HEADER_LEN || len(packet) < ihl {
+			return false
+		}
+		tcp = packet[ihl:]
+	case 0x60:
+		// TCP behind extension headers is left alone
+		if len(packet) < IPV6_HEADER_LEN || packet[6] != PROTOCOL_TCP {
+			return false
+		}
+		isIPv6 = true
+		tcp = packet[IPV6_HEADER_LEN:]
+	default:
+		return false
+	}
+
+	if len(tcp) < TCP_HEADER_LEN || tcp[13]&TCP_FLAG_SYN == 0 {
+		return false
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < TCP_HEADER_LEN || len(tcp) < dataOffset {
+		return false
+	}
+
+	if isIPv6 {
+		mss -= IPV6_HEADER_LEN - IPV4_HEADER_LEN
+	}
+	if mss <= 0 {
+		return false
+	}
+
+	options := tcp[TCP_HEADER_LEN:dataOffset]
+	for len(options) > 0 {
+		kind := options[0]
+		if kind == TCP_OPTION_END {
+			break
+		}
+		if kind == TCP_OPTION_NOP {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || options[1] < 2 || len(options) < int(options[1]) {
+			return false
+		}
+
+		if kind == TCP_OPTION_MSS && options[1] == 4 {
+			old := binary.BigEndian.Uint16(options[2:4])
+			if int(old) <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(options[2:4], uint16(mss))
+
+			// after an odd number of NOPs the value straddles two words
+			// of the checksum, which is the same as summing it swapped
+			oldWord, newWord := old, uint16(mss)
+			if (dataOffset-len(options))%2 == 1 {
+				oldWord, newWord = swap16(oldWord), swap16(newWord)
+			}
+			sum := binary.BigEndian.Uint16(tcp[16:18])
+			binary.BigEndian.PutUint16(tcp[16:18], updateChecksum(sum, oldWord, newWord))
+			return true
+		}
+		options = options[options[1]:]
+	}
+	return false
+}
+
+// updateChecksum adjusts a one's complement checksum for a 16 bit word
+// changed from old to new (RFC 1624).
+func updateChecksum(sum, old, new uint16) uint16 {
+	s := uint32(^sum) + uint32(^old) + uint32(new)
+	s = (s & 0xFFFF) + (s >> 16)
+	s = (s & 0xFFFF) + (s >> 16)
+	return ^uint16(s)
+}
+
+func swap16(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,144 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// synPacket builds a TCP SYN to port 443 with the given options, over IPv4
+// or IPv6, with a correct checksum.
+func synPacket(ipv6 bool, options []byte) []byte {
+	for len(options)%4 != 0 {
+		options = append(options, TCP_OPTION_END)
+	}
+	tcp := make([]byte, TCP_HEADER_LEN+len(options))
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 443)
+	binary.BigEndian.PutUint32(tcp[4:8], 0x01020304)
+	tcp[12] = byte(len(tcp)/4) << 4
+	tcp[13] = TCP_FLAG_SYN
+	binary.BigEndian.PutUint16(tcp[14:16], 64240)
+	copy(tcp[TCP_HEADER_LEN:], options)
+
+	var packet []byte
+	if ipv6 {
+		packet = make([]byte, IPV6_HEADER_LEN, IPV6_HEADER_LEN+len(tcp))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:6], uint16(len(tcp)))
+		packet[6] = PROTOCOL_TCP
+		packet[7] = 64
+		copy(packet[8:24], net.ParseIP("fd00::2"))
+		copy(packet[24:40], net.ParseIP("2001:db8::1"))
+	} else {
+		packet = make([]byte, IPV4_HEADER_LEN, IPV4_HEADER_LEN+len(tcp))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:4], uint16(IPV4_HEADER_LEN+len(tcp)))
+		packet[8] = 64
+		packet[9] = PROTOCOL_TCP
+		copy(packet[12:16], net.ParseIP("10.8.0.2").To4())
+		copy(packet[16:20], net.ParseIP("192.0.2.1").To4())
+	}
+	packet = append(packet, tcp...)
+	binary.BigEndian.PutUint16(packet[len(packet)-len(tcp)+16:], tcpChecksum(packet))
+	return packet
+}
+
+// tcpChecksum computes the checksum of the TCP segment of packet from
+// scratch, with its checksum field taken as zero.
+func tcpChecksum(packet []byte) uint16 {
+	var pseudo, tcp []byte
+	if packet[0]>>4 == 6 {
+		tcp = packet[IPV6_HEADER_LEN:]
+		pseudo = append(pseudo, packet[8:40]...)
+		pseudo = append(pseudo, 0, 0, byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, PROTOCOL_TCP)
+	} else {
+		tcp = packet[IPV4_HEADER_LEN:]
+		pseudo = append(pseudo, packet[12:20]...)
+		pseudo = append(pseudo, 0, PROTOCOL_TCP, byte(len(tcp)>>8), byte(len(tcp)))
+	}
+	segment := append(append([]byte{}, tcp...), 0)
+	segment[16], segment[17] = 0, 0
+
+	var sum uint32
+	for _, b := range [][]byte{pseudo, segment} {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+	}
+	for sum > 0xFFFF {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func TestClampMSS(t *testing.T) {
+	mss := func(v uint16) []byte { return []byte{TCP_OPTION_MSS, 4, byte(v >> 8), byte(v)} }
+	nop := []byte{TCP_OPTION_NOP}
+	wscale := []byte{3, 3, 7}
+	cat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+
+	for _, tc := range []struct {
+		name    string
+		options []byte
+		offset  int // of the MSS value in the TCP header
+	}{
+		{"even", mss(1460), 22},
+		{"odd after nop", cat(nop, mss(1460)), 23},
+		{"even after nops", cat(nop, nop, mss(1460)), 24},
+		{"odd after window scale", cat(wscale, mss(1460)), 25},
+		{"odd, high bytes", cat(nop, mss(0xFFF0)), 23},
+	} {
+		for _, ipv6 := range []bool{false, true} {
+			packet := synPacket(ipv6, tc.options)
+			ipLen := IPV4_HEADER_LEN
+			want := uint16(1360)
+			if ipv6 {
+				ipLen = IPV6_HEADER_LEN
+				want -= IPV6_HEADER_LEN - IPV4_HEADER_LEN
+			}
+
+			if !ClampMSS(packet, 1360) {
+				t.Errorf("%s ipv6=%v: not clamped", tc.name, ipv6)
+				continue
+			}
+			got := binary.BigEndian.Uint16(packet[ipLen+tc.offset:])
+			if got != want {
+				t.Errorf("%s ipv6=%v: mss %d, want %d", tc.name, ipv6, got, want)
+			}
+			sum := binary.BigEndian.Uint16(packet[ipLen+16:])
+			if sum != tcpChecksum(packet) {
+				t.Errorf("%s ipv6=%v: checksum %#04x, want %#04x", tc.name, ipv6, sum, tcpChecksum(packet))
+			}
+		}
+	}
+}
+
+func TestClampMSSUnchanged(t *testing.T) {
+	small := synPacket(false, []byte{TCP_OPTION_MSS, 4, 0x05, 0x00})
+	ack := synPacket(false, []byte{TCP_OPTION_MSS, 4, 0x05, 0xb4})
+	ack[IPV4_HEADER_LEN+13] = 0x10
+	broken := synPacket(false, []byte{TCP_OPTION_NOP, TCP_OPTION_MSS, 9, 0x05, 0xb4})
+
+	for name, packet := range map[string][]byte{
+		"smaller mss":   small,
+		"not a syn":     ack,
+		"broken option": broken,
+		"truncated":     small[:IPV4_HEADER_LEN+10],
+		"empty":         nil,
+	} {
+		before := append([]byte{}, packet...)
+		if ClampMSS(packet, 1360) {
+			t.Errorf("%s: clamped", name)
+		}
+		if string(before) != string(packet) {
+			t.Errorf("%s: changed", name)
+		}
+	}
+}
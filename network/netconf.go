@@ -0,0 +1,115 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Route is a route as `ip route` shows it. Dst is a CIDR or a single ip,
+// Gateway and Interface may be empty, Table 0 is the main table.
+type Route struct {
+	Dst       string
+	Gateway   string `json:",omitempty"`
+	Interface string `json:",omitempty"`
+	Table     int    `json:",omitempty"`
+	Metric    int    `json:",omitempty"`
+}
+
+func (r Route) String() string {
+	arr := []string{r.Dst}
+	if len(r.Gateway) > 0 {
+		arr = append(arr, "via", r.Gateway)
+	}
+	if len(r.Interface) > 0 {
+		arr = append(arr, "dev", r.Interface)
+	}
+	if r.Table > 0 {
+		arr = append(arr, "table", fmt.Sprint(r.Table))
+	}
+	if r.Metric > 0 {
+		arr = append(arr, "metric", fmt.Sprint(r.Metric))
+	}
+	return strings.Join(arr, " ")
+}
+
+// Rule sends the traffic from Src (all IPv4 when empty, "::/0" for all
+// IPv6) to Table. With
+// IPProto and DPort only that protocol and destination port match.
+type Rule struct {
+	Src      string `json:",omitempty"`
+	IPProto  int    `json:",omitempty"`
+	DPort    int    `json:",omitempty"`
+	Table    int
+	Priority int `json:",omitempty"`
+}
+
+func (r Rule) String() string {
+	src := r.Src
+	if len(src) < 1 {
+		src = "all"
+	}
+	s := "from " + src
+	if r.Priority > 0 {
+		s = fmt.Sprintf("priority %d %s", r.Priority, s)
+	}
+	if r.IPProto > 0 {
+		s += fmt.Sprintf(" ipproto %d", r.IPProto)
+	}
+	if r.DPort > 0 {
+		s += fmt.Sprintf(" dport %d", r.DPort)
+	}
+	return s + fmt.Sprintf(" lookup %d", r.Table)
+}
+
+// NetlinkError is returned when a change is refused. Err is the errno of
+// the kernel, so errors.Is(err, os.ErrExist) works as expected.
+type NetlinkError struct {
+	Op     string
+	Target string
+	Err    error
+}
+
+func (e *NetlinkError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Target, e.Err)
+}
+
+func (e *NetlinkError) Unwrap() error {
+	return e.Err
+}
+
+// ParsePrefix accepts a CIDR or a single ip, which is a host prefix.
+func ParsePrefix(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, prefix, err := net.ParseCIDR(s)
+		return prefix, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// SplitAddresses splits a comma separated list of addresses, like the
+// dual-stack "172.16.0.13/24,fd00::13/64".
+func SplitAddresses(s string) []string {
+	var addrs []string
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if len(a) > 0 {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// IsIPv6 reports whether the address, CIDR or "[ipv6]:port" is IPv6.
+func IsIPv6(s string) bool {
+	ip := net.ParseIP(GetIp(s))
+	return ip != nil && ip.To4() == nil
+}
@@ -0,0 +1,302 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"prousf/log"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Netlink changes links, addresses, routes and rules of the machine over
+// rtnetlink.
+type Netlink struct {
+	seq uint32
+}
+
+func NewNetlink() *Netlink {
+	return &Netlink{}
+}
+
+func (nl *Netlink) SetLinkMTU(name string, mtu int) error {
+	op := fmt.Sprintf("set mtu %d", mtu)
+	index, err := linkIndex(name)
+	if err != nil {
+		return &NetlinkError{op, name, err}
+	}
+
+	req := newRequest(unix.RTM_NEWLINK, 0)
+	req.addStruct(unsafe.Pointer(&unix.IfInfomsg{Family: unix.AF_UNSPEC, Index: index}), unix.SizeofIfInfomsg)
+	req.addUint32(unix.IFLA_MTU, uint32(mtu))
+	return nl.execute(op, name, req)
+}
+
+func (nl *Netlink) SetLinkUp(name string) error {
+	op := "set up"
+	index, err := linkIndex(name)
+	if err != nil {
+		return &NetlinkError{op, name, err}
+	}
+
+	req := newRequest(unix.RTM_NEWLINK, 0)
+	req.addStruct(unsafe.Pointer(&unix.IfInfomsg{
+		Family: unix.AF_UNSPEC,
+		Index:  index,
+		Flags:  unix.IFF_UP,
+		Change: unix.IFF_UP,
+	}), unix.SizeofIfInfomsg)
+	return nl.execute(op, name, req)
+}
+
+// AddAddress adds cidr (like 172.16.0.10/24) to the link name.
+func (nl *Netlink) AddAddress(name string, cidr string) error {
+	return nl.address(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, "add address", name, cidr)
+}
+
+func (nl *Netlink) DelAddress(name string, cidr string) error {
+	return nl.address(unix.RTM_DELADDR, 0, "delete address", name, cidr)
+}
+
+func (nl *Netlink) address(typ uint16, flags uint16, op string, name string, cidr string) error {
+	target := cidr + " dev " + name
+	ip, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return &NetlinkError{op, target, err}
+	}
+	index, err := linkIndex(name)
+	if err != nil {
+		return &NetlinkError{op, target, err}
+	}
+
+	family, ip := ipFamily(ip)
+	ones, _ := prefix.Mask.Size()
+	req := newRequest(typ, flags)
+	req.addStruct(unsafe.Pointer(&unix.IfAddrmsg{
+		Family:    family,
+		Prefixlen: uint8(ones),
+		Index:     uint32(index),
+	}), unix.SizeofIfAddrmsg)
+	req.addAttr(unix.IFA_LOCAL, ip)
+	req.addAttr(unix.IFA_ADDRESS, ip)
+	return nl.execute(op, target, req)
+}
+
+func (nl *Netlink) AddRoute(r Route) error {
+	return nl.route(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, "add route", r)
+}
+
+// ReplaceRoute adds r or replaces the route to the same destination.
+func (nl *Netlink) ReplaceRoute(r Route) error {
+	return nl.route(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, "replace route", r)
+}
+
+func (nl *Netlink) DelRoute(r Route) error {
+	return nl.route(unix.RTM_DELROUTE, 0, "delete route", r)
+}
+
+func (nl *Netlink) route(typ uint16, flags uint16, op string, r Route) error {
+	dst, err := ParsePrefix(r.Dst)
+	if err != nil {
+		return &NetlinkError{op, r.String(), err}
+	}
+	family, dstIP := ipFamily(dst.IP)
+	ones, _ := dst.Mask.Size()
+
+	msg := unix.RtMsg{
+		Family:  family,
+		Dst_len: uint8(ones),
+		Table:   unix.RT_TABLE_MAIN,
+		Scope:   unix.RT_SCOPE_NOWHERE,
+	}
+	if r.Table > 0 {
+		msg.Table = unix.RT_TABLE_UNSPEC
+		if r.Table < 256 {
+			msg.Table = uint8(r.Table)
+		}
+	}
+	if typ == unix.RTM_NEWROUTE {
+		msg.Protocol = unix.RTPROT_BOOT
+		msg.Type = unix.RTN_UNICAST
+		msg.Scope = unix.RT_SCOPE_LINK
+		if len(r.Gateway) > 0 {
+			msg.Scope = unix.RT_SCOPE_UNIVERSE
+		}
+	}
+
+	req := newRequest(typ, flags)
+	req.addStruct(unsafe.Pointer(&msg), unix.SizeofRtMsg)
+	if ones > 0 {
+		req.addAttr(unix.RTA_DST, dstIP)
+	}
+	if r.Table > 0 {
+		req.addUint32(unix.RTA_TABLE, uint32(r.Table))
+	}
+	if len(r.Gateway) > 0 {
+		gw := net.ParseIP(r.Gateway)
+		if gw == nil {
+			return &NetlinkError{op, r.String(), fmt.Errorf("invalid gateway %q", r.Gateway)}
+		}
+		_, gw = ipFamily(gw)
+		req.addAttr(unix.RTA_GATEWAY, gw)
+	}
+	if len(r.Interface) > 0 {
+		index, err := linkIndex(r.Interface)
+		if err != nil {
+			return &NetlinkError{op, r.String(), err}
+		}
+		req.addUint32(unix.RTA_OIF, uint32(index))
+	}
+	if r.Metric > 0 {
+		req.addUint32(unix.RTA_PRIORITY, uint32(r.Metric))
+	}
+	return nl.execute(op, r.String(), req)
+}
+
+func (nl *Netlink) AddRule(r Rule) error {
+	return nl.rule(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, "add rule", r)
+}
+
+func (nl *Netlink) DelRule(r Rule) error {
+	return nl.rule(unix.RTM_DELRULE, 0, "delete rule", r)
+}
+
+func (nl *Netlink) rule(typ uint16, flags uint16, op string, r Rule) error {
+	// struct fib_rule_hdr has the layout of struct rtmsg, the action is
+	// where the type is
+	msg := unix.RtMsg{
+		Family: unix.AF_INET,
+		Table:  unix.RT_TABLE_UNSPEC,
+		Type:   unix.FR_ACT_TO_TBL,
+	}
+	var src []byte
+	if len(r.Src) > 0 {
+		prefix, err := ParsePrefix(r.Src)
+		if err != nil {
+			return &NetlinkError{op, r.String(), err}
+		}
+		ones, _ := prefix.Mask.Size()
+		msg.Family, src = ipFamily(prefix.IP)
+		msg.Src_len = uint8(ones)
+		if ones == 0 {
+			src = nil
+		}
+	}
+
+	req := newRequest(typ, flags)
+	req.addStruct(unsafe.Pointer(&msg), unix.SizeofRtMsg)
+	if src != nil {
+		req.addAttr(unix.FRA_SRC, src)
+	}
+	if r.Priority > 0 {
+		req.addUint32(unix.FRA_PRIORITY, uint32(r.Priority))
+	}
+	if r.IPProto > 0 {
+		req.addAttr(unix.FRA_IP_PROTO, []byte{byte(r.IPProto)})
+	}
+	if r.DPort > 0 {
+		// struct fib_rule_port_range, start and end
+		port := uint16(r.DPort)
+		ports := [2]uint16{port, port}
+		req.addAttr(unix.FRA_DPORT_RANGE, unsafe.Slice((*byte)(unsafe.Pointer(&ports)), 4))
+	}
+	req.addUint32(unix.FRA_TABLE, uint32(r.Table))
+	return nl.execute(op, r.String(), req)
+}
+
+// execute sends req and waits for the acknowledgement of the kernel.
+func (nl *Netlink) execute(op string, target string, req *request) error {
+	log.Debug("netlink:", op, target)
+	seq := atomic.AddUint32(&nl.seq, 1)
+
+	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return &NetlinkError{op, target, err}
+	}
+	defer unix.Close(sock)
+
+	err = unix.Sendto(sock, req.serialize(seq), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return &NetlinkError{op, target, err}
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(sock, buf, 0)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return &NetlinkError{op, target, err}
+		}
+
+		for remain := buf[:n]; len(remain) >= unix.SizeofNlMsghdr; {
+			hdr := *(*unix.NlMsghdr)(unsafe.Pointer(&remain[0]))
+			if int(hdr.Len) < unix.SizeofNlMsghdr || int(hdr.Len) > len(remain) {
+				break
+			}
+
+			if hdr.Seq == seq && hdr.Type == unix.NLMSG_ERROR && int(hdr.Len) >= unix.SizeofNlMsghdr+4 {
+				code := *(*int32)(unsafe.Pointer(&remain[unix.SizeofNlMsghdr]))
+				if code == 0 {
+					return nil
+				}
+				return &NetlinkError{op, target, unix.Errno(-code)}
+			}
+			remain = remain[nlmAlign(int(hdr.Len)):]
+		}
+	}
+}
+
+type request struct {
+	typ   uint16
+	flags uint16
+	data  []byte
+}
+
+func newRequest(typ uint16, flags uint16) *request {
+	return &request{typ: typ, flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK | flags}
+}
+
+func (req *request) addStruct(p unsafe.Pointer, size int) {
+	req.data = append(req.data, unsafe.Slice((*byte)(p), size)...)
+	req.data = append(req.data, make([]byte, nlmAlign(len(req.data))-len(req.data))...)
+}
+
+func (req *request) addAttr(typ uint16, value []byte) {
+	attr := unix.RtAttr{Len: uint16(unix.SizeofRtAttr + len(value)), Type: typ}
+	req.addStruct(unsafe.Pointer(&attr), unix.SizeofRtAttr)
+	req.data = append(req.data, value...)
+	req.data = append(req.data, make([]byte, nlmAlign(len(req.data))-len(req.data))...)
+}
+
+func (req *request) addUint32(typ uint16, value uint32) {
+	req.addAttr(typ, unsafe.Slice((*byte)(unsafe.Pointer(&value)), 4))
+}
+
+func (req *request) serialize(seq uint32) []byte {
+	hdr := unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + len(req.data)),
+		Type:  req.typ,
+		Flags: req.flags,
+		Seq:   seq,
+	}
+	b := append([]byte(nil), unsafe.Slice((*byte)(unsafe.Pointer(&hdr)), unix.SizeofNlMsghdr)...)
+	return append(b, req.data...)
+}
+
+func linkIndex(name string) (int32, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return int32(iface.Index), nil
+}
+
+func ipFamily(ip net.IP) (uint8, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return unix.AF_INET, ip4
+	}
+	return unix.AF_INET6, ip.To16()
+}
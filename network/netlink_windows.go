@@ -0,0 +1,50 @@
+package network
+
+import (
+	"fmt"
+)
+
+var errNetlink = fmt.Errorf("netlink is only available on linux")
+
+// Netlink is linux only, on windows the routes are set with route.exe.
+type Netlink struct{}
+
+func NewNetlink() *Netlink {
+	return &Netlink{}
+}
+
+func (nl *Netlink) SetLinkMTU(name string, mtu int) error {
+	return errNetlink
+}
+
+func (nl *Netlink) SetLinkUp(name string) error {
+	return errNetlink
+}
+
+func (nl *Netlink) AddAddress(name string, cidr string) error {
+	return errNetlink
+}
+
+func (nl *Netlink) DelAddress(name string, cidr string) error {
+	return errNetlink
+}
+
+func (nl *Netlink) AddRoute(r Route) error {
+	return errNetlink
+}
+
+func (nl *Netlink) ReplaceRoute(r Route) error {
+	return errNetlink
+}
+
+func (nl *Netlink) DelRoute(r Route) error {
+	return errNetlink
+}
+
+func (nl *Netlink) AddRule(r Rule) error {
+	return errNetlink
+}
+
+func (nl *Netlink) DelRule(r Rule) error {
+	return errNetlink
+}
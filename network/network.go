@@ -1,9 +1,12 @@
 package network
 
 import (
+	"encoding/hex"
 	"fmt"
 	"net"
+	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -20,6 +23,11 @@ type WindowsRouter struct {
 	Metric      string
 }
 
+type LinuxRouter struct {
+	Gateway   string
+	Interface string
+}
+
 type PacketHeader struct {
 	IPSrc    net.IP
 	IPDst    net.IP
@@ -99,6 +107,92 @@ func GetDefaultGatewayWindows() (WindowsRouter, error) {
 
 }
 
+func GetDefaultGatewayLinux() (LinuxRouter, error) {
+	var route = LinuxRouter{}
+	b, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return route, fmt.Errorf("get default gateway err: %v", err)
+	}
+
+	lines := strings.Split(string(b), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gw == 0 {
+			continue
+		}
+
+		// the kernel prints the address in host (little endian) order
+		route = LinuxRouter{
+			Gateway:   net.IPv4(byte(gw), byte(gw>>8), byte(gw>>16), byte(gw>>24)).String(),
+			Interface: fields[0],
+		}
+		return route, nil
+	}
+
+	return route, fmt.Errorf("get default gateway err: no gateway")
+}
+
+// GetDefaultGateway6Linux reads the IPv6 default route from
+// /proc/net/ipv6_route.
+func GetDefaultGateway6Linux() (LinuxRouter, error) {
+	var route = LinuxRouter{}
+	b, err := os.ReadFile("/proc/net/ipv6_route")
+	if err != nil {
+		return route, fmt.Errorf("get default gateway err: %v", err)
+	}
+
+	zero := strings.Repeat("0", 32)
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[0] != zero || fields[1] != "00" || fields[4] == zero || fields[9] == "lo" {
+			continue
+		}
+
+		gw, err := hex.DecodeString(fields[4])
+		if err != nil {
+			continue
+		}
+		route = LinuxRouter{
+			Gateway:   net.IP(gw).String(),
+			Interface: fields[9],
+		}
+		return route, nil
+	}
+
+	return route, fmt.Errorf("get default gateway err: no gateway")
+}
+
+// GetDefaultGateway6Windows reads the IPv6 default route from
+// "route print -6", Interface is the index of the interface.
+func GetDefaultGateway6Windows() (WindowsRouter, error) {
+	var route = WindowsRouter{}
+	output, err := exec.Command("route", "print", "-6", "::/0").CombinedOutput()
+	if err != nil {
+		return route, fmt.Errorf("get default gateway err: %v", err)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[2] != "::/0" || fields[3] == "On-link" {
+			continue
+		}
+		route = WindowsRouter{
+			Destination: fields[2],
+			Gateway:     fields[3],
+			Interface:   fields[0],
+			Metric:      fields[1],
+		}
+		return route, nil
+	}
+
+	return route, fmt.Errorf("get default gateway err: no gateway")
+}
+
 func FindPhysicalInterface(DstTest string) (net.Interface, error) {
 	var p physicalInterface
 	p.DstTest = DstTest
@@ -125,7 +219,7 @@ L:
 		}
 
 		for numberAddr, addr := range addrs {
-			if outboundIP == addr.String() {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(outboundIP) {
 				if p.sendReqTest(&i, numberAddr) {
 					internetInterface = i
 					break L
@@ -155,34 +249,33 @@ func (p physicalInterface) sendReqTest(ief *net.Interface, numberAddr int) bool
 	return true
 }
 
-func (p physicalInterface) getOutboundIP() (string, error) {
+func (p physicalInterface) getOutboundIP() (net.IP, error) {
 	conn, err := net.Dial("tcp", p.DstTest)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer conn.Close()
 
-	localAddr := conn.LocalAddr().(*net.TCPAddr)
-	sz, _ := net.IPMask(localAddr.IP.DefaultMask()).Size()
-	return fmt.Sprintf("%v/%v", net.IP(localAddr.IP), sz), nil
+	return conn.LocalAddr().(*net.TCPAddr).IP, nil
 }
 
-func CIDRToMask(ip string) string {
-	_, ipv4Net, _ := net.ParseCIDR(ip)
-	return ipv4MaskString(ipv4Net.Mask)
+// CIDRToMask returns the mask of a CIDR as an address, "255.255.255.0"
+// or "ffff:ffff:ffff:ffff::".
+func CIDRToMask(cidr string) string {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ""
+	}
+	return net.IP(ipNet.Mask).String()
 }
 
+// GetIp returns the address of "ip:port", "[ipv6]:port" or a CIDR.
 func GetIp(str string) string {
-	if strings.Contains(str, ":") {
-		return str[:strings.Index(str, ":")]
+	if host, _, err := net.SplitHostPort(str); err == nil {
+		return host
 	}
-	return str[:strings.Index(str, "/")]
-}
-
-func ipv4MaskString(m []byte) string {
-	if len(m) != 4 {
-		panic("ipv4Mask: len must be 4 bytes")
+	if i := strings.Index(str, "/"); i >= 0 {
+		return str[:i]
 	}
-
-	return fmt.Sprintf("%d.%d.%d.%d", m[0], m[1], m[2], m[3])
+	return str
 }
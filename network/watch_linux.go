@@ -0,0 +1,86 @@
+package network
+
+import (
+	"net"
+	"prousf/log"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// WatchChanges sends on the returned channel whenever a link goes up or
+// down or an address is added or removed on an interface other than
+// ignore. Events are coalesced, a slow reader only sees the last one.
+func WatchChanges(ignore string) (<-chan struct{}, error) {
+	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+
+	saddr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	}
+	err = unix.Bind(sock, saddr)
+	if err != nil {
+		unix.Close(sock)
+		return nil, err
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer unix.Close(sock)
+		for msg := make([]byte, 1<<16); ; {
+			msgn, _, _, _, err := unix.Recvmsg(sock, msg, nil, 0)
+			if err != nil {
+				if err == unix.EINTR || err == unix.ENOBUFS {
+					continue
+				}
+				log.Error("watch network changes error:", err)
+				return
+			}
+
+			ignoreIndex := int32(-1)
+			if iface, err := net.InterfaceByName(ignore); err == nil {
+				ignoreIndex = int32(iface.Index)
+			}
+
+			changed := false
+			for remain := msg[:msgn]; len(remain) >= unix.SizeofNlMsghdr; {
+				hdr := *(*unix.NlMsghdr)(unsafe.Pointer(&remain[0]))
+				if int(hdr.Len) > len(remain) || hdr.Len < unix.SizeofNlMsghdr {
+					break
+				}
+				body := remain[unix.SizeofNlMsghdr:hdr.Len]
+				remain = remain[nlmAlign(int(hdr.Len)):]
+
+				switch hdr.Type {
+				case unix.RTM_NEWLINK, unix.RTM_DELLINK:
+					if len(body) < unix.SizeofIfInfomsg {
+						continue
+					}
+					info := *(*unix.IfInfomsg)(unsafe.Pointer(&body[0]))
+					changed = changed || info.Index != ignoreIndex
+				case unix.RTM_NEWADDR, unix.RTM_DELADDR:
+					if len(body) < unix.SizeofIfAddrmsg {
+						continue
+					}
+					info := *(*unix.IfAddrmsg)(unsafe.Pointer(&body[0]))
+					changed = changed || int32(info.Index) != ignoreIndex
+				}
+			}
+
+			if changed {
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
+
+func nlmAlign(n int) int {
+	return (n + unix.NLMSG_ALIGNTO - 1) & ^(unix.NLMSG_ALIGNTO - 1)
+}
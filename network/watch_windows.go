@@ -0,0 +1,61 @@
+package network
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const WATCH_INTERVAL = 3 * time.Second
+
+// WatchChanges sends on the returned channel whenever the addresses of the
+// interfaces other than ignore change. Windows has no cheap notification
+// we can use without cgo, so the interfaces are polled.
+func WatchChanges(ignore string) (<-chan struct{}, error) {
+	last, err := interfacesState(ignore)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		for range time.Tick(WATCH_INTERVAL) {
+			state, err := interfacesState(ignore)
+			if err != nil || state == last {
+				continue
+			}
+			last = state
+
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
+
+func interfacesState(ignore string) (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	var state []string
+	for _, i := range ifaces {
+		if i.Name == ignore || i.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			state = append(state, i.Name+"="+addr.String())
+		}
+	}
+	sort.Strings(state)
+	return strings.Join(state, ","), nil
+}
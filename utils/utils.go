@@ -14,13 +14,13 @@ func GenUUID() string {
 	return strings.ReplaceAll(uuid.New().String(), "-", "")
 }
 
+// ValidServer splits "host:port" or "[ipv6]:port", the port defaults to
+// 80, and resolves host to the first address of either family.
 func ValidServer(server string) (string, string, error) {
-	arr := strings.Split(server, ":")
-	host := server
-	port := "80"
-	if len(arr) > 0 {
-		host = arr[0]
-		port = arr[1]
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host = strings.Trim(server, "[]")
+		port = "80"
 	}
 
 	if checkNotIPAddress(host) {
@@ -32,15 +32,10 @@ func ValidServer(server string) (string, string, error) {
 		if len(ips) < 1 {
 			return "", "", fmt.Errorf("dns lookup %s not found", host)
 		}
-
-		for _, ip := range ips {
-			if ip.To4() != nil {
-				return host, ip.String() + ":" + port, nil
-			}
-		}
+		return host, net.JoinHostPort(ips[0].String(), port), nil
 	}
 
-	return host, server, nil
+	return host, net.JoinHostPort(host, port), nil
 }
 
 func checkNotIPAddress(ip string) bool {
@@ -0,0 +1,147 @@
+package vpn
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/s2"
+)
+
+const (
+	COMPRESS_S2      = "s2"
+	COMPRESS_DEFLATE = "deflate"
+
+	COMPRESS_RAW  = 0
+	COMPRESS_DONE = 1
+
+	COMPRESS_MIN_SIZE    = 64
+	COMPRESS_MAX_SKIP    = 64
+	COMPRESS_MAX_FRAME   = 1 << 20
+	COMPRESS_MIN_SAVINGS = 8 // compressed frame must be at least 1/8 smaller
+)
+
+func supportCompress(algo string) bool {
+	return algo == COMPRESS_S2 || algo == COMPRESS_DEFLATE
+}
+
+// compressor prefixes every frame with one byte telling whether the rest is
+// compressed. Frames that don't shrink are sent raw, and after each such
+// miss the following frames skip compression for an exponentially growing
+// number of frames so incompressible traffic (TLS, video) costs almost
+// nothing.
+type compressor struct {
+	algo    string
+	stats   *tunnelStats
+	skip    int
+	backoff int
+
+	buf bytes.Buffer
+	fw  *flate.Writer
+}
+
+func newCompressor(algo string, stats *tunnelStats) *compressor {
+	return &compressor{
+		algo:  algo,
+		stats: stats,
+	}
+}
+
+func (c *compressor) compress(frame []byte) []byte {
+	out := c.tryCompress(frame)
+	c.stats.addCompress(len(frame), len(out))
+	return out
+}
+
+func (c *compressor) tryCompress(frame []byte) []byte {
+	if len(frame) < COMPRESS_MIN_SIZE {
+		return rawFrame(frame)
+	}
+
+	if c.skip > 0 {
+		c.skip--
+		return rawFrame(frame)
+	}
+
+	if compress.Estimate(frame) < 0.05 {
+		c.miss()
+		return rawFrame(frame)
+	}
+
+	var out []byte
+	switch c.algo {
+	case COMPRESS_S2:
+		buf := make([]byte, 1+s2.MaxEncodedLen(len(frame)))
+		out = buf[:1+len(s2.Encode(buf[1:], frame))]
+	case COMPRESS_DEFLATE:
+		c.buf.Reset()
+		c.buf.WriteByte(COMPRESS_DONE)
+		if c.fw == nil {
+			c.fw, _ = flate.NewWriter(&c.buf, flate.BestSpeed)
+		} else {
+			c.fw.Reset(&c.buf)
+		}
+		c.fw.Write(frame)
+		c.fw.Close()
+		out = c.buf.Bytes()
+	default:
+		return rawFrame(frame)
+	}
+
+	if len(out) > len(frame)-len(frame)/COMPRESS_MIN_SAVINGS {
+		c.miss()
+		return rawFrame(frame)
+	}
+
+	c.backoff = 0
+	out[0] = COMPRESS_DONE
+	return out
+}
+
+func (c *compressor) miss() {
+	if c.backoff < COMPRESS_MAX_SKIP {
+		c.backoff = c.backoff*2 + 1
+	}
+	c.skip = c.backoff
+}
+
+func rawFrame(frame []byte) []byte {
+	return append([]byte{COMPRESS_RAW}, frame...)
+}
+
+func decompress(algo string, frame []byte) ([]byte, error) {
+	if len(frame) < 1 {
+		return nil, fmt.Errorf("compressed frame empty")
+	}
+
+	if frame[0] == COMPRESS_RAW {
+		return frame[1:], nil
+	}
+
+	switch algo {
+	case COMPRESS_S2:
+		n, err := s2.DecodedLen(frame[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n > COMPRESS_MAX_FRAME {
+			return nil, fmt.Errorf("compressed frame too large: %d", n)
+		}
+		return s2.Decode(nil, frame[1:])
+	case COMPRESS_DEFLATE:
+		fr := flate.NewReader(bytes.NewReader(frame[1:]))
+		defer fr.Close()
+		out, err := io.ReadAll(io.LimitReader(fr, COMPRESS_MAX_FRAME+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > COMPRESS_MAX_FRAME {
+			return nil, fmt.Errorf("compressed frame too large")
+		}
+		return out, nil
+	}
+
+	return nil, fmt.Errorf("not support compress: %v", algo)
+}
@@ -0,0 +1,51 @@
+package vpn
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// newDecoy returns the website served to everything that is not a valid
+// tunnel handshake: a reverse proxy when target is an http(s) URL, the
+// files of a directory otherwise.
+func newDecoy(target string) (http.Handler, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid decoy %s: %v", target, err)
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+			r.Host = u.Host
+		}
+		return proxy, nil
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid decoy %s: %v", target, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("invalid decoy %s: not a directory", target)
+	}
+	return http.FileServer(http.Dir(target)), nil
+}
+
+// reject answers a request that is not a tunnel handshake, with the decoy
+// website when there is one.
+func (vpn *VPN) reject(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if vpn.decoy != nil {
+		vpn.decoy.ServeHTTP(w, r)
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write([]byte(message))
+}
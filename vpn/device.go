@@ -0,0 +1,65 @@
+package vpn
+
+import (
+	"os"
+	"prousf/tun"
+	"sync"
+)
+
+// memDevice stands in for the tun interface when no real one may be
+// created, in dry runs. Packets handed to In are read from it, packets
+// written to it are kept in Written.
+type memDevice struct {
+	mu      sync.Mutex
+	name    string
+	mtu     int
+	In      chan []byte
+	Written [][]byte
+	events  chan tun.Event
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newMemDevice(name string, mtu int) *memDevice {
+	return &memDevice{
+		name:   name,
+		mtu:    mtu,
+		In:     make(chan []byte, 16),
+		events: make(chan tun.Event, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+func (d *memDevice) File() *os.File { return nil }
+
+func (d *memDevice) Read(buf []byte, offset int) (int, error) {
+	select {
+	case packet := <-d.In:
+		return copy(buf[offset:], packet), nil
+	case <-d.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (d *memDevice) Write(buf []byte, offset int) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Written = append(d.Written, append([]byte(nil), buf[offset:]...))
+	return len(buf) - offset, nil
+}
+
+func (d *memDevice) Flush() error { return nil }
+
+func (d *memDevice) MTU() (int, error) { return d.mtu, nil }
+
+func (d *memDevice) Name() (string, error) { return d.name, nil }
+
+func (d *memDevice) Events() chan tun.Event { return d.events }
+
+func (d *memDevice) Close() error {
+	d.once.Do(func() {
+		close(d.closed)
+		close(d.events)
+	})
+	return nil
+}
@@ -0,0 +1,366 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"prousf/log"
+	"prousf/network"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DNS_TIMEOUT  = 5 * time.Second
+	DNS_MAX_SIZE = 65535
+	RESOLV_CONF  = "/etc/resolv.conf"
+	// the servers systemd-resolved forwards to, resolv.conf has its stub
+	RESOLVED_CONF = "/run/systemd/resolve/resolv.conf"
+)
+
+// The DNS forwarder relays queries to the upstream resolver. When the
+// question matches one of Domains, the addresses in the answer get a host
+// route into the tunnel before the answer is sent back, so the first
+// connection already goes through the VPN. A route lives as long as the
+// TTL of the answer, but at least DomainTTL. The forwarder is the resolver
+// of the machine while it runs, without DNSUpstream it asks the DNS servers
+// of the tunnel once connected.
+
+type dnsForwarder struct {
+	vpn     *VPN
+	domains []string
+
+	mu       sync.Mutex
+	upstream string
+	routes   map[string]*dnsRoute
+}
+
+type dnsRoute struct {
+	timer  *time.Timer
+	expire time.Time
+}
+
+func (vpn *VPN) startDNSForwarder() error {
+	upstream := vpn.conf.DNSUpstream
+	if len(upstream) < 1 {
+		var err error
+		upstream, err = systemResolver()
+		if err != nil {
+			return err
+		}
+	}
+	upstream = dnsAddr(upstream)
+	if upstream == vpn.conf.DNSListen {
+		return fmt.Errorf("DNS upstream %s is the forwarder itself, set DNSUpstream", upstream)
+	}
+
+	f := &dnsForwarder{
+		vpn:      vpn,
+		upstream: upstream,
+		routes:   make(map[string]*dnsRoute),
+	}
+	for _, d := range vpn.conf.Domains {
+		f.domains = append(f.domains, strings.ToLower(strings.TrimSuffix(d, ".")))
+	}
+
+	udp, err := net.ListenPacket("udp", vpn.conf.DNSListen)
+	if err != nil {
+		return err
+	}
+	tcp, err := net.Listen("tcp", vpn.conf.DNSListen)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+
+	log.Info("DNS forwarder:", vpn.conf.DNSListen, "->", upstream)
+	go f.serveUDP(udp)
+	go f.serveTCP(tcp)
+	vpn.forwarder = f
+
+	// resolvers are set without a port
+	host, port, _ := net.SplitHostPort(vpn.conf.DNSListen)
+	if port != "53" {
+		log.Error("DNSListen", vpn.conf.DNSListen, "is not on port 53, the system resolver is left as is")
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return vpn.journal.setDNS(TUN_NAME, []string{host})
+}
+
+func (f *dnsForwarder) serveUDP(conn net.PacketConn) {
+	for {
+		buf := make([]byte, DNS_MAX_SIZE)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Error("dns forwarder error:", err)
+			return
+		}
+
+		go func() {
+			answer, err := f.exchange("udp", buf[:n])
+			if err != nil {
+				log.Debug("dns forward error:", err)
+				return
+			}
+			conn.WriteTo(answer, addr)
+		}()
+	}
+}
+
+func (f *dnsForwarder) serveTCP(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			log.Error("dns forwarder error:", err)
+			return
+		}
+
+		go func() {
+			defer c.Close()
+			for {
+				c.SetDeadline(time.Now().Add(DNS_TIMEOUT))
+				query, err := readTCPMessage(c)
+				if err != nil {
+					return
+				}
+				answer, err := f.exchange("tcp", query)
+				if err != nil {
+					log.Debug("dns forward error:", err)
+					return
+				}
+				err = writeTCPMessage(c, answer)
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (f *dnsForwarder) setUpstream(upstream string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.upstream = dnsAddr(upstream)
+}
+
+// exchange sends query upstream and routes the matching answers.
+func (f *dnsForwarder) exchange(proto string, query []byte) ([]byte, error) {
+	f.mu.Lock()
+	upstream := f.upstream
+	f.mu.Unlock()
+	c, err := net.DialTimeout(proto, upstream, DNS_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(DNS_TIMEOUT))
+
+	var answer []byte
+	if proto == "tcp" {
+		err = writeTCPMessage(c, query)
+		if err != nil {
+			return nil, err
+		}
+		answer, err = readTCPMessage(c)
+	} else {
+		_, err = c.Write(query)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, DNS_MAX_SIZE)
+		var n int
+		n, err = c.Read(buf)
+		answer = buf[:n]
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f.routeAnswer(answer)
+	return answer, nil
+}
+
+func (f *dnsForwarder) routeAnswer(msg []byte) {
+	var p dnsmessage.Parser
+	_, err := p.Start(msg)
+	if err != nil {
+		return
+	}
+	q, err := p.Question()
+	if err != nil || !f.match(q.Name.String()) {
+		return
+	}
+	err = p.SkipAllQuestions()
+	if err != nil {
+		return
+	}
+
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return
+			}
+			f.addRoute(net.IP(r.A[:]), time.Duration(h.TTL)*time.Second, q.Name.String())
+		case dnsmessage.TypeAAAA:
+			if !f.vpn.hasIPv6() {
+				err = p.SkipAnswer()
+				if err != nil {
+					return
+				}
+				continue
+			}
+			r, err := p.AAAAResource()
+			if err != nil {
+				return
+			}
+			f.addRoute(net.IP(r.AAAA[:]), time.Duration(h.TTL)*time.Second, q.Name.String())
+		default:
+			err = p.SkipAnswer()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// match reports whether name is one of the domains, "*.example.com"
+// matches every name below example.com.
+func (f *dnsForwarder) match(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, d := range f.domains {
+		if strings.HasPrefix(d, "*.") {
+			if name == d[2:] || strings.HasSuffix(name, d[1:]) {
+				return true
+			}
+		} else if name == d {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *dnsForwarder) addRoute(ip net.IP, ttl time.Duration, name string) {
+	if ttl < f.vpn.conf.DomainTTL {
+		ttl = f.vpn.conf.DomainTTL
+	}
+
+	key := ip.String()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if rt, found := f.routes[key]; found {
+		rt.expire = time.Now().Add(ttl)
+		rt.timer.Reset(ttl)
+		return
+	}
+
+	r := f.vpn.tunnelRoute(key)
+	err := f.vpn.addRoute(r)
+	if err != nil {
+		log.Error("route", name, "error:", err)
+		return
+	}
+	log.Debug("route", name, key, "for", ttl)
+
+	rt := &dnsRoute{expire: time.Now().Add(ttl)}
+	rt.timer = time.AfterFunc(ttl, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		// answered again while the timer fired
+		if time.Now().Before(rt.expire) {
+			return
+		}
+		delete(f.routes, key)
+		err := f.vpn.delRoute(r)
+		if err != nil {
+			log.Debug("delete route", key, "error:", err)
+		}
+	})
+	f.routes[key] = rt
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	_, err := io.ReadFull(r, l[:])
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	b := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+// dnsAddr adds the DNS port to a server without one.
+func dnsAddr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, "53")
+	}
+	return server
+}
+
+// systemResolver is the first nameserver of resolv.conf, or the first
+// server behind systemd-resolved when it runs.
+func systemResolver() (string, error) {
+	servers, err := systemResolvers()
+	if err != nil {
+		return "", fmt.Errorf("no DNSUpstream and %v", err)
+	}
+	if len(servers) < 1 {
+		return "", fmt.Errorf("no DNSUpstream and no nameserver in %s", RESOLV_CONF)
+	}
+	return servers[0], nil
+}
+
+func systemResolvers() ([]string, error) {
+	b, err := os.ReadFile(RESOLVED_CONF)
+	if err != nil {
+		b, err = os.ReadFile(RESOLV_CONF)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []string
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers, nil
+}
+
+// tunnelRoute is the route sending dst into the tunnel. DefaultGateway is
+// IPv4, IPv6 routes go to the interface.
+func (vpn *VPN) tunnelRoute(dst string) network.Route {
+	if network.IsIPv6(dst) {
+		return network.Route{Dst: dst, Interface: TUN_NAME, Metric: 5}
+	}
+	return network.Route{
+		Dst:       dst,
+		Gateway:   vpn.conf.DefaultGateway,
+		Interface: TUN_NAME,
+		Metric:    5,
+	}
+}
@@ -0,0 +1,20 @@
+package vpn
+
+import "testing"
+
+func TestForwarderMatch(t *testing.T) {
+	f := &dnsForwarder{domains: []string{"*.example.com", "host.example.org"}}
+	for name, want := range map[string]bool{
+		"example.com.":         true,
+		"www.example.com":      true,
+		"a.b.Example.COM.":     true,
+		"notexample.com":       false,
+		"host.example.org.":    true,
+		"www.host.example.org": false,
+		"example.org":          false,
+	} {
+		if got := f.match(name); got != want {
+			t.Errorf("match(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const BATCH_HEADER_LEN = 2
+
+// A batch frame is a sequence of packets, each prefixed by its length as
+// a big endian uint16, encrypted as a single websocket message.
+func appendPacket(frame []byte, packet []byte) []byte {
+	frame = append(frame, 0, 0)
+	binary.BigEndian.PutUint16(frame[len(frame)-BATCH_HEADER_LEN:], uint16(len(packet)))
+	return append(frame, packet...)
+}
+
+func splitPackets(frame []byte, fn func(packet []byte) error) error {
+	for len(frame) > 0 {
+		if len(frame) < BATCH_HEADER_LEN {
+			return fmt.Errorf("batch frame truncated")
+		}
+
+		n := int(binary.BigEndian.Uint16(frame))
+		frame = frame[BATCH_HEADER_LEN:]
+		if len(frame) < n {
+			return fmt.Errorf("batch frame truncated")
+		}
+
+		err := fn(frame[:n])
+		if err != nil {
+			return err
+		}
+		frame = frame[n:]
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package vpn
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+func testPackets(n int, size int) [][]byte {
+	packets := make([][]byte, n)
+	for i := range packets {
+		packets[i] = bytes.Repeat([]byte{byte(i)}, size+i%7)
+	}
+	return packets
+}
+
+func TestSplitPackets(t *testing.T) {
+	packets := testPackets(10, 100)
+	var frame []byte
+	for _, p := range packets {
+		frame = appendPacket(frame, p)
+	}
+
+	var got [][]byte
+	err := splitPackets(frame, func(packet []byte) error {
+		got = append(got, packet)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(packets) {
+		t.Fatalf("got %d packets, want %d", len(got), len(packets))
+	}
+	for i := range packets {
+		if !bytes.Equal(got[i], packets[i]) {
+			t.Fatalf("packet %d differs", i)
+		}
+	}
+
+	for _, n := range []int{1, BATCH_HEADER_LEN + 50, len(frame) - 1} {
+		err = splitPackets(frame[:n], func(packet []byte) error { return nil })
+		if err == nil {
+			t.Errorf("frame truncated to %d bytes: no error", n)
+		}
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, opts := range []tunnelOptions{
+		{Batch: true},
+		{Batch: true, Compress: COMPRESS_S2},
+		{Batch: true, Compress: COMPRESS_DEFLATE},
+		{Batch: true, Obfs: OBFS_LIGHT},
+	} {
+		t.Run(opts.String(), func(t *testing.T) {
+			client, server := tunnelPair(t, opts)
+			packets := testPackets(20, 200)
+			var frame []byte
+			for _, p := range packets {
+				frame = appendPacket(frame, p)
+			}
+			err := client.writeFrame(frame, len(packets))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, message, err := server.conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := server.readFrame(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			i := 0
+			err = splitPackets(raw, func(packet []byte) error {
+				if !bytes.Equal(packet, packets[i]) {
+					return fmt.Errorf("packet %d differs", i)
+				}
+				i++
+				return nil
+			})
+			if err != nil || i != len(packets) {
+				t.Fatalf("got %d of %d packets: %v", i, len(packets), err)
+			}
+		})
+	}
+}
+
+// benchmarkFrames sends b.N packets of 500 bytes, batch packets per frame.
+func benchmarkFrames(b *testing.B, batch int) {
+	client, server := tunnelPair(b, tunnelOptions{Batch: batch > 1})
+	packet := bytes.Repeat([]byte{0x45}, 500)
+
+	done := make(chan error, 1)
+	go func() {
+		for received := 0; received < b.N; {
+			_, message, err := server.conn.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			raw, err := server.readFrame(message)
+			if err != nil {
+				done <- err
+				return
+			}
+			if !server.opts.Batch {
+				received++
+				continue
+			}
+			err = splitPackets(raw, func(packet []byte) error {
+				received++
+				return nil
+			})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	var frame []byte
+	for sent := 0; sent < b.N; {
+		n := batch
+		if b.N-sent < n {
+			n = b.N - sent
+		}
+		if batch > 1 {
+			frame = frame[:0]
+			for i := 0; i < n; i++ {
+				frame = appendPacket(frame, packet)
+			}
+		} else {
+			frame = packet
+		}
+		err := client.writeFrame(frame, n)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sent += n
+	}
+	err := <-done
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "packets/s")
+}
+
+func BenchmarkFrameUnbatched(b *testing.B) { benchmarkFrames(b, 1) }
+
+func BenchmarkFrameBatched(b *testing.B) { benchmarkFrames(b, 16) }
+
+func TestTextPadded(t *testing.T) {
+	client, server := tunnelPair(t, tunnelOptions{Batch: true, Keepalive: true, Obfs: OBFS_BALANCED})
+
+	err := client.writeFrame(appendPacket(nil, []byte("0123456789")), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.writeText(PING + " 42")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, data, err := server.conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	messType, ping, err := server.conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messType != websocket.BinaryMessage || len(ping) != len(data) {
+		t.Errorf("ping sent as type %d of %d bytes, data frames are %d bytes", messType, len(ping), len(data))
+	}
+
+	frame, err := server.readFrame(ping)
+	if err != nil || frame != nil {
+		t.Fatalf("ping read as data %q: %v", frame, err)
+	}
+	select {
+	case ts := <-server.pings:
+		if ts != "42" {
+			t.Errorf("ping timestamp %q", ts)
+		}
+	default:
+		t.Errorf("ping not handled")
+	}
+}
@@ -0,0 +1,245 @@
+package vpn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"prousf/log"
+	"prousf/network"
+	"sync"
+)
+
+// journal makes the changes to the routes and addresses of the machine.
+// Before a change is made, what undoes it is saved to the state file, so
+// the changes are reverted on exit and, when the process was killed, on
+// the next start.
+type journal struct {
+	mu     sync.Mutex
+	path   string
+	routes RouteManager
+	dryRun bool
+	undo   []change
+}
+
+// change is one saved undo step: an address, a route, a rule, the kill
+// switch or the NAT to delete, or the resolvers or a sysctl to restore.
+type change struct {
+	Link    string         `json:",omitempty"`
+	Address string         `json:",omitempty"`
+	Route   *network.Route `json:",omitempty"`
+	Rule    *network.Rule  `json:",omitempty"`
+	DNS     bool           `json:",omitempty"`
+	Kill    bool           `json:",omitempty"`
+	NAT     bool           `json:",omitempty"`
+	Sysctl  string         `json:",omitempty"`
+	Value   string         `json:",omitempty"`
+}
+
+// defaultStatePath is the state file when none is configured. It is not
+// writable by other users and differs by mode, so a client and a server on
+// the same machine don't revert each other's changes.
+func defaultStatePath(server bool) string {
+	name := "prousf-client.state"
+	if server {
+		name = "prousf-server.state"
+	}
+	if YOUR_OS == "windows" {
+		return filepath.Join(os.TempDir(), name)
+	}
+	return filepath.Join(STATE_DIR, name)
+}
+
+// openJournal reverts whatever a previous run left in the state file.
+// A dry run keeps the journal in memory only.
+func openJournal(path string, routes RouteManager, dryRun bool) *journal {
+	j := &journal{path: path, routes: routes, dryRun: dryRun}
+	if dryRun {
+		return j
+	}
+
+	f, err := openStateFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("open state file error:", err)
+		}
+		return j
+	}
+	b, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		log.Error("read state file error:", err)
+		return j
+	}
+	err = json.Unmarshal(b, &j.undo)
+	if err != nil {
+		log.Error("read state file error:", err)
+	}
+	if len(j.undo) > 0 {
+		log.Info("Revert changes left by a previous run")
+	}
+	j.revert()
+	return j
+}
+
+func (j *journal) addAddress(link string, cidr string) error {
+	j.record(change{Link: link, Address: cidr})
+	return j.routes.AddAddress(link, cidr)
+}
+
+// addRoute replaces a route left to the same destination.
+func (j *journal) addRoute(r network.Route) error {
+	j.record(change{Route: &r})
+	return j.routes.AddRoute(r)
+}
+
+func (j *journal) addRule(r network.Rule) error {
+	j.record(change{Rule: &r})
+	return j.routes.AddRule(r)
+}
+
+func (j *journal) setDNS(link string, servers []string) error {
+	j.record(change{Link: link, DNS: true})
+	return j.routes.SetDNS(link, servers)
+}
+
+// setKillSwitch replaces the kill switch, which is recorded once.
+func (j *journal) setKillSwitch(link string, allow []string) error {
+	if !j.recorded(change{Kill: true}) {
+		j.record(change{Kill: true})
+	}
+	return j.routes.AddKillSwitch(link, allow)
+}
+
+// setNAT replaces the NAT, which is recorded once.
+func (j *journal) setNAT(link string, egress string, subnets []string) error {
+	if !j.recorded(change{NAT: true}) {
+		j.record(change{NAT: true})
+	}
+	return j.routes.AddNAT(link, egress, subnets)
+}
+
+// setSysctl records the value key had, when it changes.
+func (j *journal) setSysctl(key string, value string) error {
+	old, err := j.routes.Sysctl(key)
+	if err != nil {
+		return err
+	}
+	if old == value {
+		return nil
+	}
+	j.record(change{Sysctl: key, Value: old})
+	return j.routes.SetSysctl(key, value)
+}
+
+// delRoute deletes a route added by addRoute.
+func (j *journal) delRoute(r network.Route) error {
+	j.mu.Lock()
+	for i, c := range j.undo {
+		if c.Route != nil && *c.Route == r {
+			j.undo = append(j.undo[:i:i], j.undo[i+1:]...)
+			break
+		}
+	}
+	if !j.dryRun {
+		err := j.save()
+		if err != nil {
+			log.Error("save state file error:", err)
+		}
+	}
+	j.mu.Unlock()
+	return j.routes.DelRoute(r)
+}
+
+func (j *journal) recorded(c change) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, u := range j.undo {
+		if u == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *journal) record(c change) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.undo = append(j.undo, c)
+	if j.dryRun {
+		return
+	}
+
+	err := j.save()
+	if err != nil {
+		log.Error("save state file error:", err)
+	}
+}
+
+// revert undoes the changes newest first. Some of them may already be
+// gone with the tun interface, so failures are only logged.
+func (j *journal) revert() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := len(j.undo) - 1; i >= 0; i-- {
+		var err error
+		c := j.undo[i]
+		switch {
+		case c.Route != nil:
+			err = j.routes.DelRoute(*c.Route)
+		case c.Rule != nil:
+			err = j.routes.DelRule(*c.Rule)
+		case c.Kill:
+			err = j.routes.DelKillSwitch()
+		case c.NAT:
+			err = j.routes.DelNAT()
+		case len(c.Sysctl) > 0:
+			// the state file could name any key, only ours are replayed
+			if (c.Sysctl != IP_FORWARD && c.Sysctl != IP6_FORWARD) || (c.Value != "0" && c.Value != "1") {
+				err = fmt.Errorf("sysctl %s = %q is not replayed", c.Sysctl, c.Value)
+				break
+			}
+			err = j.routes.SetSysctl(c.Sysctl, c.Value)
+		case c.DNS:
+			err = j.routes.SetDNS(c.Link, nil)
+		case len(c.Address) > 0:
+			err = j.routes.DelAddress(c.Link, c.Address)
+		}
+		if err != nil {
+			log.Debug("revert error:", err)
+		}
+	}
+	j.undo = nil
+	if j.dryRun {
+		return
+	}
+
+	err := os.Remove(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("remove state file error:", err)
+	}
+}
+
+func (j *journal) save() error {
+	b, err := json.Marshal(j.undo)
+	if err != nil {
+		return err
+	}
+
+	// a file or link left at tmp is replaced, never written through
+	tmp := j.path + ".tmp"
+	os.Remove(tmp)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
@@ -0,0 +1,31 @@
+package vpn
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const STATE_DIR = "/run"
+
+// openStateFile opens the state file without following a link, and only
+// when it belongs to us and nobody else can write it: its changes are
+// replayed as root.
+func openStateFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.Mode().IsRegular() || !ok || int(st.Uid) != os.Geteuid() || fi.Mode().Perm()&0022 != 0 {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a private file of this user, ignored", path)
+	}
+	return f, nil
+}
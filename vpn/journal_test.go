@@ -0,0 +1,30 @@
+package vpn
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"prousf/network"
+)
+
+func TestJournalReplaysOnlyForwarding(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	state := `[{"Sysctl":"net/ipv4/ip_forward","Value":"0"},` +
+		`{"Sysctl":"../../etc/passwd","Value":"0"},` +
+		`{"Sysctl":"net/ipv4/ip_forward","Value":"x"}]`
+	err := os.WriteFile(path, []byte(state), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := newRecordRoutes(network.Route{}, network.Route{}, false)
+	openJournal(path, rec, false)
+	want := []string{"set sysctl " + IP_FORWARD + "=0"}
+	if len(rec.Changes) != len(want) || rec.Changes[0] != want[0] {
+		t.Errorf("changes %q, want %q", rec.Changes, want)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file left after the replay: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+package vpn
+
+import (
+	"fmt"
+	"os"
+)
+
+const STATE_DIR = ""
+
+// openStateFile opens the state file unless it is a link.
+func openStateFile(path string) (*os.File, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file, ignored", path)
+	}
+	return os.Open(path)
+}
@@ -0,0 +1,79 @@
+package vpn
+
+import (
+	"fmt"
+	"prousf/log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PING = "ping"
+	PONG = "pong"
+)
+
+// With the keepalive option both peers send "ping <unix nano>" every TTL
+// and answer each ping with "pong" and the same timestamp, so the sender
+// measures the round trip on its own clock. A peer that leaves MissedPongs
+// pings in a row unanswered is considered dead.
+
+func (t *tunnel) sendPing() error {
+	if !t.opts.Keepalive {
+		return t.writeText(PING)
+	}
+
+	missed := atomic.AddInt32(&t.missedPongs, 1) - 1
+	if missed >= int32(t.maxMissedPongs) {
+		return fmt.Errorf("peer %v dead, %d pongs missed", t.conn.RemoteAddr(), missed)
+	}
+
+	msg := fmt.Sprintf("%s %d", PING, time.Now().UnixNano())
+	return t.writeText(msg)
+}
+
+func (t *tunnel) sendPong(ts string) error {
+	return t.writeText(PONG + " " + ts)
+}
+
+// handleText is called by the reader for every text message, and for the
+// ones padded into binary frames. Pongs must be
+// written by the writer goroutine, so pings are handed over in t.pings.
+func (t *tunnel) handleText(message []byte) {
+	kind, ts, found := strings.Cut(string(message), " ")
+	if kind == GOAWAY {
+		t.handleGoAway(ts)
+		return
+	}
+
+	if !t.opts.Keepalive || !found {
+		return
+	}
+
+	switch kind {
+	case PING:
+		select {
+		case t.pings <- ts:
+		default:
+		}
+	case PONG:
+		sent, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return
+		}
+		atomic.StoreInt32(&t.missedPongs, 0)
+		rtt := time.Since(time.Unix(0, sent))
+		t.stats.addRTT(rtt)
+		log.Trace("pong", t.conn.RemoteAddr(), "rtt", rtt)
+	}
+}
+
+// readTimeout is how long the reader waits for any message before it gives
+// up on the peer.
+func (t *tunnel) readTimeout(ttl time.Duration) time.Duration {
+	if !t.opts.Keepalive {
+		return ttl * 4 / 3
+	}
+	return ttl*time.Duration(t.maxMissedPongs) + ttl/3
+}
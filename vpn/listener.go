@@ -0,0 +1,209 @@
+package vpn
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"prousf/network"
+	"strings"
+)
+
+const (
+	UNIX_PREFIX     = "unix:"
+	FORWARDED_FOR   = "X-Forwarded-For"
+	UNIX_SOCKET_MOD = 0660
+
+	TRANSPORT_WEBSOCKET = "websocket"
+)
+
+// Listener is one address the server accepts clients on. All listeners
+// share the same session table.
+type Listener struct {
+	Address       string
+	SSL           bool
+	SSLCrt        string
+	SSLKey        string
+	ProxyProtocol bool
+
+	// extra certificates, picked by the SNI of the client
+	Certificates []Certificate
+
+	// transports offered on this listener, empty means all of them
+	Transports []string
+}
+
+type Certificate struct {
+	SSLCrt string
+	SSLKey string
+}
+
+func (l Listener) String() string {
+	if l.SSL {
+		return l.Address + " - SSL"
+	}
+	return l.Address + " - No SSL"
+}
+
+func (l Listener) allowTransport(transport string) bool {
+	if len(l.Transports) < 1 {
+		return true
+	}
+
+	for _, t := range l.Transports {
+		if t == transport {
+			return true
+		}
+	}
+	return false
+}
+
+func (l Listener) tlsConfig() (*tls.Config, error) {
+	certs := l.Certificates
+	if len(l.SSLCrt) > 0 {
+		certs = append([]Certificate{{SSLCrt: l.SSLCrt, SSLKey: l.SSLKey}}, certs...)
+	}
+
+	tlsConfig := &tls.Config{
+		NextProtos: []string{"http/1.1"},
+	}
+	for _, c := range certs {
+		cert, err := tls.LoadX509KeyPair(c.SSLCrt, c.SSLKey)
+		if err != nil {
+			return nil, fmt.Errorf("load cert %s: %v", c.SSLCrt, err)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+
+	if len(tlsConfig.Certificates) < 1 {
+		return nil, fmt.Errorf("listener %s: no certificate", l.Address)
+	}
+	return tlsConfig, nil
+}
+
+// listen opens a TCP listener, or a unix socket for addresses written as
+// "unix:/path/to/socket", wrapped in TLS when the listener has SSL.
+func (vpn *VPN) listen(l Listener) (net.Listener, error) {
+	addr := l.Address
+	netType := "tcp"
+	if strings.HasPrefix(addr, UNIX_PREFIX) {
+		netType = "unix"
+		addr = strings.TrimPrefix(addr, UNIX_PREFIX)
+		os.Remove(addr)
+	}
+
+	ln, err := net.Listen(netType, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if netType == "unix" {
+		err = os.Chmod(addr, UNIX_SOCKET_MOD)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	if l.ProxyProtocol {
+		ln = network.NewProxyProtoListener(ln, vpn.isTrustedProxy)
+	}
+
+	if l.SSL {
+		tlsConfig, err := l.tlsConfig()
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return ln, nil
+}
+
+func (vpn *VPN) setupTrustedProxies() error {
+	for _, p := range vpn.conf.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %s: %v", p, err)
+		}
+		vpn.trustedProxies = append(vpn.trustedProxies, ipNet)
+	}
+	return nil
+}
+
+// isTrustedProxy reports whether addr may tell us the real client address.
+// Peers on a unix socket are always local, so they are trusted.
+func (vpn *VPN) isTrustedProxy(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.UnixAddr:
+		return true
+	case *net.TCPAddr:
+		return vpn.trustedIP(a.IP)
+	}
+	return false
+}
+
+func (vpn *VPN) trustedIP(ip net.IP) bool {
+	for _, ipNet := range vpn.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the real client address of r: the last hop of
+// X-Forwarded-For that is not one of our proxies, when the request comes
+// from a trusted proxy, r.RemoteAddr otherwise.
+func (vpn *VPN) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip != nil && !vpn.trustedIP(ip) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values(FORWARDED_FOR), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			break
+		}
+
+		host = hop
+		if !vpn.trustedIP(hopIP) {
+			break
+		}
+	}
+	return host
+}
+
+// withPrefix serves h under prefix, with the prefix removed from the path.
+func (vpn *VPN) withPrefix(prefix string, h http.Handler) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if len(prefix) < 1 {
+		return h
+	}
+
+	stripped := http.StripPrefix(prefix, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			vpn.reject(w, r, http.StatusNotFound, "404 page not found\n")
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
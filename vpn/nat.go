@@ -0,0 +1,61 @@
+package vpn
+
+import (
+	"fmt"
+	"prousf/log"
+	"strings"
+)
+
+const (
+	IP_FORWARD  = "net/ipv4/ip_forward"
+	IP6_FORWARD = "net/ipv6/conf/all/forwarding"
+)
+
+// setupNAT lets the clients out through the egress interface of the
+// server: forwarding on and the VPN subnets masqueraded. Both are undone
+// on shutdown.
+func (vpn *VPN) setupNAT() error {
+	egress := vpn.conf.NATInterface
+	if len(egress) < 1 {
+		var err error
+		egress, err = vpn.egressInterface()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := vpn.journal.setSysctl(IP_FORWARD, "1")
+	if err != nil {
+		return err
+	}
+	if vpn.hasIPv6() {
+		err = vpn.journal.setSysctl(IP6_FORWARD, "1")
+		if err != nil {
+			return err
+		}
+	}
+
+	var subnets []string
+	for _, n := range vpn.myNetworks {
+		subnets = append(subnets, n.String())
+	}
+	err = vpn.journal.setNAT(TUN_NAME, egress, subnets)
+	if err != nil {
+		return err
+	}
+	log.Info("NAT:", strings.Join(subnets, ", "), "->", egress)
+	return nil
+}
+
+// egressInterface is the interface of the default route, the IPv6 one on
+// a server without IPv4.
+func (vpn *VPN) egressInterface() (string, error) {
+	gateway, err := vpn.routes.DefaultGateway()
+	if err != nil || len(gateway.Interface) < 1 {
+		gateway, err = vpn.routes.DefaultGateway6()
+	}
+	if err != nil || len(gateway.Interface) < 1 {
+		return "", fmt.Errorf("cannot find the egress interface, set NATInterface")
+	}
+	return gateway.Interface, nil
+}
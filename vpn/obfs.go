@@ -0,0 +1,121 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	OBFS_OFF      = "off"
+	OBFS_LIGHT    = "light"
+	OBFS_BALANCED = "balanced"
+	OBFS_PARANOID = "paranoid"
+
+	OBFS_HEADER_LEN = 4
+	// set in the length of a text message sent padded
+	OBFS_TEXT = 1 << 31
+)
+
+// obfsProfile trades bandwidth and latency for a less recognizable traffic
+// shape: frames are padded up to the next bucket, batches are flushed and
+// cover frames sent a random delay up to Jitter later than they would be,
+// and an idle tunnel sends a cover frame every Cover.
+type obfsProfile struct {
+	Buckets []int
+	Jitter  time.Duration
+	Cover   time.Duration
+}
+
+var obfsProfiles = map[string]obfsProfile{
+	OBFS_LIGHT: {
+		Buckets: []int{128, 256, 512, 1024, 1536},
+	},
+	OBFS_BALANCED: {
+		Buckets: []int{256, 512, 1024, 1536},
+		Jitter:  5 * time.Millisecond,
+		Cover:   2 * time.Second,
+	},
+	OBFS_PARANOID: {
+		Buckets: []int{1536},
+		Jitter:  20 * time.Millisecond,
+		Cover:   300 * time.Millisecond,
+	},
+}
+
+func supportObfs(profile string) bool {
+	_, found := obfsProfiles[profile]
+	return found
+}
+
+// An obfuscated frame is the payload length as a big endian uint32, the
+// payload and zero padding. Cover frames have an empty payload. Pings,
+// pongs and goaway are padded too, with OBFS_TEXT set in the length, so
+// they look like data.
+type obfuscator struct {
+	profile obfsProfile
+	rand    *rand.Rand
+}
+
+func newObfuscator(profile string) *obfuscator {
+	return &obfuscator{
+		profile: obfsProfiles[profile],
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (o *obfuscator) pad(frame []byte) []byte {
+	return o.padFlags(frame, 0)
+}
+
+func (o *obfuscator) padText(msg []byte) []byte {
+	return o.padFlags(msg, OBFS_TEXT)
+}
+
+func (o *obfuscator) padFlags(frame []byte, flags uint32) []byte {
+	n := OBFS_HEADER_LEN + len(frame)
+	size := o.bucket(n)
+	out := make([]byte, size)
+	binary.BigEndian.PutUint32(out, uint32(len(frame))|flags)
+	copy(out[OBFS_HEADER_LEN:], frame)
+	return out
+}
+
+func (o *obfuscator) bucket(n int) int {
+	for _, b := range o.profile.Buckets {
+		if n <= b {
+			return b
+		}
+	}
+
+	// larger than every bucket (a batch), round up to the largest one
+	largest := o.profile.Buckets[len(o.profile.Buckets)-1]
+	return (n + largest - 1) / largest * largest
+}
+
+func (o *obfuscator) cover() []byte {
+	buckets := o.profile.Buckets
+	return make([]byte, buckets[o.rand.Intn(len(buckets))])
+}
+
+func (o *obfuscator) delay() time.Duration {
+	if o.profile.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(o.rand.Int63n(int64(o.profile.Jitter)))
+}
+
+// unpad returns the payload of frame and whether it is a text message.
+func unpad(frame []byte) ([]byte, bool, error) {
+	if len(frame) < OBFS_HEADER_LEN {
+		return nil, false, fmt.Errorf("padded frame truncated")
+	}
+
+	header := binary.BigEndian.Uint32(frame)
+	n := int(header &^ OBFS_TEXT)
+	if len(frame) < OBFS_HEADER_LEN+n {
+		return nil, false, fmt.Errorf("padded frame truncated")
+	}
+	return frame[OBFS_HEADER_LEN : OBFS_HEADER_LEN+n], header&OBFS_TEXT != 0, nil
+}
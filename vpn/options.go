@@ -0,0 +1,101 @@
+package vpn
+
+import (
+	"strings"
+)
+
+const (
+	OPTIONS_HEADER = "X-Options"
+
+	OPTION_BATCH     = "batch"
+	OPTION_COMPRESS  = "compress"
+	OPTION_OBFS      = "obfs"
+	OPTION_KEEPALIVE = "keepalive"
+)
+
+// tunnelOptions are negotiated during the websocket handshake: the client
+// sends the options it wants in OPTIONS_HEADER and the server answers with
+// the subset it accepted. Peers that don't know the header get none.
+type tunnelOptions struct {
+	Batch     bool
+	Compress  string
+	Obfs      string
+	Keepalive bool
+}
+
+func parseOptions(s string) tunnelOptions {
+	var opts tunnelOptions
+	for _, o := range strings.Split(s, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(o), "=")
+		switch name {
+		case OPTION_BATCH:
+			opts.Batch = true
+		case OPTION_COMPRESS:
+			if supportCompress(value) {
+				opts.Compress = value
+			}
+		case OPTION_OBFS:
+			if supportObfs(value) {
+				opts.Obfs = value
+			}
+		case OPTION_KEEPALIVE:
+			opts.Keepalive = true
+		}
+	}
+	return opts
+}
+
+func (opts tunnelOptions) String() string {
+	var arr []string
+	if opts.Batch {
+		arr = append(arr, OPTION_BATCH)
+	}
+	if len(opts.Compress) > 0 {
+		arr = append(arr, OPTION_COMPRESS+"="+opts.Compress)
+	}
+	if len(opts.Obfs) > 0 {
+		arr = append(arr, OPTION_OBFS+"="+opts.Obfs)
+	}
+	if opts.Keepalive {
+		arr = append(arr, OPTION_KEEPALIVE)
+	}
+	return strings.Join(arr, ",")
+}
+
+func (vpn *VPN) wantOptions() tunnelOptions {
+	opts := tunnelOptions{
+		Batch:     vpn.conf.BatchSize > 0,
+		Keepalive: true,
+	}
+	if supportCompress(vpn.conf.Compress) {
+		opts.Compress = vpn.conf.Compress
+	}
+	if supportObfs(vpn.conf.Obfuscation) {
+		opts.Obfs = vpn.conf.Obfuscation
+	}
+	return opts
+}
+
+func (vpn *VPN) acceptOptions(req tunnelOptions) tunnelOptions {
+	opts := tunnelOptions{
+		Batch:     req.Batch && vpn.conf.BatchSize > 0,
+		Keepalive: req.Keepalive,
+	}
+	// on the server Compress and Obfuscation list everything clients may pick
+	if len(req.Compress) > 0 && inList(vpn.conf.Compress, req.Compress) {
+		opts.Compress = req.Compress
+	}
+	if len(req.Obfs) > 0 && inList(vpn.conf.Obfuscation, req.Obfs) {
+		opts.Obfs = req.Obfs
+	}
+	return opts
+}
+
+func inList(list string, value string) bool {
+	for _, v := range strings.Split(list, ",") {
+		if strings.TrimSpace(v) == value {
+			return true
+		}
+	}
+	return false
+}
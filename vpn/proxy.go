@@ -0,0 +1,73 @@
+package vpn
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+const (
+	PROXY_DIRECT = "direct"
+)
+
+// proxyFunc returns the proxy used to reach the server. An empty Proxy
+// falls back to HTTPS_PROXY/HTTP_PROXY/NO_PROXY from the environment,
+// "direct" ignores the environment.
+func (vpn *VPN) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if vpn.conf.Proxy == PROXY_DIRECT {
+		return nil, nil
+	}
+
+	if len(vpn.conf.Proxy) < 1 {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := parseProxy(vpn.conf.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// proxyAddr returns the proxy that will be used for s, if any, so routes
+// can keep it outside of the tunnel.
+func (vpn *VPN) proxyAddr(s Server) string {
+	proxy, err := vpn.proxyFunc()
+	if err != nil || proxy == nil {
+		return ""
+	}
+
+	scheme := "http"
+	if vpn.conf.SSL {
+		scheme = "https"
+	}
+	req, err := http.NewRequest("GET", scheme+"://"+s.Address, nil)
+	if err != nil {
+		return ""
+	}
+
+	proxyURL, err := proxy(req)
+	if err != nil || proxyURL == nil {
+		return ""
+	}
+	return proxyURL.Host
+}
+
+func parseProxy(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %v", proxy, err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "socks5":
+	default:
+		return nil, fmt.Errorf("not support proxy scheme: %v", proxyURL.Scheme)
+	}
+
+	if _, _, err := net.SplitHostPort(proxyURL.Host); err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %v", proxy, err)
+	}
+	return proxyURL, nil
+}
@@ -0,0 +1,107 @@
+package vpn
+
+import (
+	"errors"
+	"os"
+	"prousf/log"
+	"prousf/network"
+	"strings"
+)
+
+const (
+	DNS_HEADER = "X-DNS"
+
+	INTERCEPT_TABLE    = 53
+	INTERCEPT_PRIORITY = 53
+	DNS_PORT           = 53
+)
+
+// applyDNS makes the configured DNS servers, or the ones the server
+// pushed, the resolvers of the machine while the client runs, or the
+// upstream of the forwarder when it runs. The servers are routed into the
+// tunnel so the queries never go out directly.
+func (vpn *VPN) applyDNS(pushed string) error {
+	if vpn.forwarder != nil && len(vpn.conf.DNSUpstream) > 0 {
+		return nil
+	}
+
+	servers := vpn.conf.DNS
+	if len(servers) < 1 && len(pushed) > 0 {
+		for _, s := range strings.Split(pushed, ",") {
+			servers = append(servers, strings.TrimSpace(s))
+		}
+	}
+	if len(servers) < 1 || strings.Join(servers, ",") == strings.Join(vpn.dnsServers, ",") {
+		return nil
+	}
+
+	for _, s := range servers {
+		err := vpn.addRoute(vpn.tunnelRoute(s))
+		if err != nil {
+			return err
+		}
+	}
+
+	// the forwarder stays the resolver
+	if vpn.forwarder != nil {
+		vpn.forwarder.setUpstream(servers[0])
+		log.Info("DNS forwarder upstream:", servers[0])
+		vpn.dnsServers = servers
+		return nil
+	}
+
+	err := vpn.journal.setDNS(TUN_NAME, servers)
+	if err != nil {
+		return err
+	}
+	log.Info("DNS servers:", strings.Join(servers, ", "))
+	vpn.dnsServers = servers
+	return nil
+}
+
+// interceptDNS sends every packet to port 53 into the tunnel, whatever
+// resolver it was meant for.
+func (vpn *VPN) interceptDNS() error {
+	if YOUR_OS != "linux" {
+		log.Error("DNSIntercept is not supported on", YOUR_OS)
+		return nil
+	}
+
+	err := vpn.interceptFamily("0.0.0.0/0", "")
+	if err != nil {
+		return err
+	}
+	// IPv6 queries go into the tunnel too, dropped there when it has no
+	// IPv6, but a host without IPv6 has no queries to intercept
+	err = vpn.interceptFamily("::/0", "::/0")
+	if err != nil && vpn.hasIPv6() {
+		return err
+	}
+	if err != nil {
+		log.Debug("intercept IPv6 DNS error:", err)
+	}
+	return nil
+}
+
+func (vpn *VPN) interceptFamily(dst string, src string) error {
+	r := vpn.tunnelRoute(dst)
+	r.Table = INTERCEPT_TABLE
+	err := vpn.journal.addRoute(r)
+	if err != nil {
+		return err
+	}
+
+	for _, proto := range []int{network.PROTOCOL_UDP, network.PROTOCOL_TCP} {
+		err = vpn.journal.addRule(network.Rule{
+			Src:      src,
+			IPProto:  proto,
+			DPort:    DNS_PORT,
+			Table:    INTERCEPT_TABLE,
+			Priority: INTERCEPT_PRIORITY,
+		})
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package vpn
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// fatalError is an error retrying won't fix, like wrong credentials.
+type fatalError struct {
+	err error
+}
+
+func (e fatalError) Error() string {
+	return e.err.Error()
+}
+
+func (e fatalError) Unwrap() error {
+	return e.err
+}
+
+func fatal(err error) error {
+	return fatalError{err}
+}
+
+func isFatal(err error) bool {
+	var f fatalError
+	return errors.As(err, &f)
+}
+
+// backoff doubles the delay between attempts up to RetryMax, each wait is
+// picked at random in [delay/2, delay] so clients don't reconnect in sync.
+type backoff struct {
+	min   time.Duration
+	max   time.Duration
+	delay time.Duration
+}
+
+func newBackoff(min time.Duration, max time.Duration) *backoff {
+	if max < min {
+		max = min
+	}
+	return &backoff{
+		min:   min,
+		max:   max,
+		delay: min,
+	}
+}
+
+func (b *backoff) next() time.Duration {
+	d := b.delay
+	b.delay *= 2
+	if b.delay > b.max {
+		b.delay = b.max
+	}
+
+	if d < 2 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+func (b *backoff) reset() {
+	b.delay = b.min
+}
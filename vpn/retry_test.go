@@ -0,0 +1,66 @@
+package vpn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"prousf/network"
+)
+
+// startTestClient runs Create as a client of a server answering every
+// request with handler.
+func startTestClient(t *testing.T, handler http.HandlerFunc, maxRetries int) error {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	_, err := Create(Config{
+		MTU:            1400,
+		LocalAddr:      "10.8.0.2/24",
+		DefaultGateway: "10.8.0.1",
+		Users:          []User{{Name: "u", Pass: "wrong"}},
+		Servers:        []Server{{Address: strings.TrimPrefix(srv.URL, "http://")}},
+		Proxy:          PROXY_DIRECT,
+		TunnelPath:     "/tunnel",
+		AuthHeader:     "Cookie",
+		RetryMin:       time.Millisecond,
+		RetryMax:       time.Millisecond,
+		MaxRetries:     maxRetries,
+		StateFile:      filepath.Join(t.TempDir(), "state"),
+		Routes:         newRecordRoutes(network.Route{Dst: "0.0.0.0/0", Gateway: "192.0.2.1", Interface: "eth0"}, network.Route{}, false),
+		Device:         newMemDevice(TUN_NAME, 1400),
+	})
+	return err
+}
+
+func TestCreateReturnsFatalError(t *testing.T) {
+	for name, handler := range map[string]http.HandlerFunc{
+		"plain": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(ERROR_AUTHENTICATION_FAILED))
+		},
+		"decoy": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(ERROR_HEADER, ERROR_AUTHENTICATION_FAILED)
+			w.Write([]byte("<html>welcome</html>"))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := startTestClient(t, handler, 0)
+			if !isFatal(err) {
+				t.Errorf("got %v, want a fatal error", err)
+			}
+		})
+	}
+}
+
+func TestCreateGivesUp(t *testing.T) {
+	err := startTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, 2)
+	if err == nil || isFatal(err) {
+		t.Errorf("got %v, want the give up error", err)
+	}
+}
@@ -0,0 +1,239 @@
+package vpn
+
+import (
+	"fmt"
+	"os"
+	"prousf/log"
+	"prousf/network"
+	"strings"
+	"sync"
+)
+
+// RouteManager changes the network configuration of the machine. Each OS
+// has its own, newRecordRoutes only pretends to.
+type RouteManager interface {
+	// SetLink sets the MTU of the link and brings it up.
+	SetLink(link string, mtu int) error
+	AddAddress(link string, cidr string) error
+	DelAddress(link string, cidr string) error
+	// AddRoute replaces a route to the same destination.
+	AddRoute(r network.Route) error
+	DelRoute(r network.Route) error
+	AddRule(r network.Rule) error
+	DelRule(r network.Rule) error
+	DefaultGateway() (network.Route, error)
+	DefaultGateway6() (network.Route, error)
+	// SetDNS makes servers the resolvers of the machine, no servers
+	// restore the previous ones.
+	SetDNS(link string, servers []string) error
+	// AddKillSwitch drops every packet leaving the machine but the ones on
+	// link, on loopback and to the allow list. It replaces the previous one.
+	AddKillSwitch(link string, allow []string) error
+	DelKillSwitch() error
+	// Sysctl reads a kernel parameter like "net/ipv4/ip_forward".
+	Sysctl(key string) (string, error)
+	SetSysctl(key string, value string) error
+	// AddNAT masquerades the traffic of subnets leaving through egress and
+	// drops new connections from egress to link. It replaces the previous
+	// one.
+	AddNAT(link string, egress string, subnets []string) error
+	DelNAT() error
+}
+
+// recordRoutes keeps the configuration in memory and records every
+// change, for dry runs and to test the bring-up without privileges.
+type recordRoutes struct {
+	mu       sync.Mutex
+	verbose  bool
+	gateway  network.Route
+	gateway6 network.Route
+
+	Changes   []string
+	Links     map[string]int
+	Addresses map[string][]string
+	Routes    map[string]network.Route
+	Rules     map[string]network.Rule
+	DNS       map[string][]string
+	// KillSwitch is the allow list, nil when there is no kill switch
+	KillSwitch []string
+	Sysctls    map[string]string
+	// NAT is the egress interface, empty when there is no NAT
+	NAT string
+}
+
+// newRecordRoutes answers DefaultGateway with gateway and DefaultGateway6
+// with gateway6, verbose logs every change.
+func newRecordRoutes(gateway network.Route, gateway6 network.Route, verbose bool) *recordRoutes {
+	return &recordRoutes{
+		verbose:   verbose,
+		gateway:   gateway,
+		gateway6:  gateway6,
+		Links:     make(map[string]int),
+		Addresses: make(map[string][]string),
+		Routes:    make(map[string]network.Route),
+		Rules:     make(map[string]network.Rule),
+		DNS:       make(map[string][]string),
+		Sysctls:   make(map[string]string),
+	}
+}
+
+func (rec *recordRoutes) record(format string, a ...interface{}) {
+	change := fmt.Sprintf(format, a...)
+	rec.Changes = append(rec.Changes, change)
+	if rec.verbose {
+		log.Info("dry-run:", change)
+	}
+}
+
+func (rec *recordRoutes) SetLink(link string, mtu int) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record("set link %s mtu %d up", link, mtu)
+	rec.Links[link] = mtu
+	return nil
+}
+
+func (rec *recordRoutes) AddAddress(link string, cidr string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record("add address %s dev %s", cidr, link)
+	for _, a := range rec.Addresses[link] {
+		if a == cidr {
+			return &network.NetlinkError{Op: "add address", Target: cidr, Err: os.ErrExist}
+		}
+	}
+	rec.Addresses[link] = append(rec.Addresses[link], cidr)
+	return nil
+}
+
+func (rec *recordRoutes) DelAddress(link string, cidr string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record("delete address %s dev %s", cidr, link)
+	addrs := rec.Addresses[link]
+	for i, a := range addrs {
+		if a == cidr {
+			rec.Addresses[link] = append(addrs[:i:i], addrs[i+1:]...)
+			return nil
+		}
+	}
+	return &network.NetlinkError{Op: "delete address", Target: cidr, Err: os.ErrNotExist}
+}
+
+func (rec *recordRoutes) AddRoute(r network.Route) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record("add route %v", r)
+	rec.Routes[routeKey(r)] = r
+	return nil
+}
+
+func (rec *recordRoutes) DelRoute(r network.Route) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record("delete route %v", r)
+	if _, found := rec.Routes[routeKey(r)]; !found {
+		return &network.NetlinkError{Op: "delete route", Target: r.String(), Err: os.ErrNotExist}
+	}
+	delete(rec.Routes, routeKey(r))
+	return nil
+}
+
+func (rec *recordRoutes) AddRule(r network.Rule) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record("add rule %v", r)
+	if _, found := rec.Rules[r.String()]; found {
+		return &network.NetlinkError{Op: "add rule", Target: r.String(), Err: os.ErrExist}
+	}
+	rec.Rules[r.String()] = r
+	return nil
+}
+
+func (rec *recordRoutes) DelRule(r network.Rule) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record("delete rule %v", r)
+	if _, found := rec.Rules[r.String()]; !found {
+		return &network.NetlinkError{Op: "delete rule", Target: r.String(), Err: os.ErrNotExist}
+	}
+	delete(rec.Rules, r.String())
+	return nil
+}
+
+func (rec *recordRoutes) DefaultGateway() (network.Route, error) {
+	if len(rec.gateway.Gateway) < 1 {
+		return rec.gateway, fmt.Errorf("get default gateway err: no gateway")
+	}
+	return rec.gateway, nil
+}
+
+func (rec *recordRoutes) DefaultGateway6() (network.Route, error) {
+	if len(rec.gateway6.Gateway) < 1 {
+		return rec.gateway6, fmt.Errorf("get default gateway err: no gateway")
+	}
+	return rec.gateway6, nil
+}
+
+func (rec *recordRoutes) SetDNS(link string, servers []string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(servers) < 1 {
+		rec.record("restore dns dev %s", link)
+		delete(rec.DNS, link)
+		return nil
+	}
+	rec.record("set dns %s dev %s", strings.Join(servers, ","), link)
+	rec.DNS[link] = servers
+	return nil
+}
+
+func (rec *recordRoutes) AddKillSwitch(link string, allow []string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record("add kill switch dev %s allow %s", link, strings.Join(allow, ","))
+	rec.KillSwitch = append([]string{}, allow...)
+	return nil
+}
+
+func (rec *recordRoutes) DelKillSwitch() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record("delete kill switch")
+	rec.KillSwitch = nil
+	return nil
+}
+
+func (rec *recordRoutes) Sysctl(key string) (string, error) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.Sysctls[key], nil
+}
+
+func (rec *recordRoutes) SetSysctl(key string, value string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record("set sysctl %s=%s", key, value)
+	rec.Sysctls[key] = value
+	return nil
+}
+
+func (rec *recordRoutes) AddNAT(link string, egress string, subnets []string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record("add nat %s dev %s via %s", strings.Join(subnets, ","), link, egress)
+	rec.NAT = egress
+	return nil
+}
+
+func (rec *recordRoutes) DelNAT() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record("delete nat")
+	rec.NAT = ""
+	return nil
+}
+
+func routeKey(r network.Route) string {
+	return fmt.Sprintf("%s table %d", r.Dst, r.Table)
+}
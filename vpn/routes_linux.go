@@ -0,0 +1,231 @@
+package vpn
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"prousf/log"
+	"prousf/network"
+	"strings"
+)
+
+const (
+	RESOLVED_DIR   = "/run/systemd/resolve"
+	RESOLV_BACKUP  = RESOLV_CONF + ".prousf"
+	RESOLV_HEADER  = "# generated by prousf, the original is in " + RESOLV_BACKUP + "\n"
+	RESOLVECTL_CMD = "resolvectl"
+
+	NFT_CMD          = "nft"
+	KILLSWITCH_TABLE = "inet prousf"
+	NAT_TABLE        = "inet prousf_nat"
+	SYSCTL_DIR       = "/proc/sys/"
+)
+
+type linuxRoutes struct {
+	nl *network.Netlink
+}
+
+func newSystemRoutes() RouteManager {
+	return &linuxRoutes{nl: network.NewNetlink()}
+}
+
+func (lr *linuxRoutes) SetLink(link string, mtu int) error {
+	err := lr.nl.SetLinkMTU(link, mtu)
+	if err != nil {
+		return err
+	}
+	return lr.nl.SetLinkUp(link)
+}
+
+func (lr *linuxRoutes) AddAddress(link string, cidr string) error {
+	return lr.nl.AddAddress(link, cidr)
+}
+
+func (lr *linuxRoutes) DelAddress(link string, cidr string) error {
+	return lr.nl.DelAddress(link, cidr)
+}
+
+func (lr *linuxRoutes) AddRoute(r network.Route) error {
+	return lr.nl.ReplaceRoute(r)
+}
+
+func (lr *linuxRoutes) DelRoute(r network.Route) error {
+	return lr.nl.DelRoute(r)
+}
+
+func (lr *linuxRoutes) AddRule(r network.Rule) error {
+	return lr.nl.AddRule(r)
+}
+
+func (lr *linuxRoutes) DelRule(r network.Rule) error {
+	return lr.nl.DelRule(r)
+}
+
+func (lr *linuxRoutes) DefaultGateway() (network.Route, error) {
+	gw, err := network.GetDefaultGatewayLinux()
+	if err != nil {
+		return network.Route{}, err
+	}
+	return network.Route{Dst: "0.0.0.0/0", Gateway: gw.Gateway, Interface: gw.Interface}, nil
+}
+
+func (lr *linuxRoutes) DefaultGateway6() (network.Route, error) {
+	gw, err := network.GetDefaultGateway6Linux()
+	if err != nil {
+		return network.Route{}, err
+	}
+	return network.Route{Dst: "::/0", Gateway: gw.Gateway, Interface: gw.Interface}, nil
+}
+
+// SetDNS hands the servers to systemd-resolved for the link, as the
+// resolvers of every domain. Without systemd-resolved resolv.conf is
+// rewritten and the original kept aside until it is restored.
+func (lr *linuxRoutes) SetDNS(link string, servers []string) error {
+	if useResolved() {
+		if len(servers) < 1 {
+			return runCmd(RESOLVECTL_CMD, "revert", link)
+		}
+		err := runCmd(RESOLVECTL_CMD, append([]string{"dns", link}, servers...)...)
+		if err != nil {
+			return err
+		}
+		return runCmd(RESOLVECTL_CMD, "domain", link, "~.")
+	}
+
+	if len(servers) < 1 {
+		b, err := os.ReadFile(RESOLV_BACKUP)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(RESOLV_CONF, b, 0644)
+		if err != nil {
+			return err
+		}
+		return os.Remove(RESOLV_BACKUP)
+	}
+
+	// keep the first backup, a crashed run left ours in resolv.conf
+	if _, err := os.Stat(RESOLV_BACKUP); os.IsNotExist(err) {
+		b, err := os.ReadFile(RESOLV_CONF)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(RESOLV_BACKUP, b, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	conf := RESOLV_HEADER
+	for _, s := range servers {
+		conf += "nameserver " + s + "\n"
+	}
+	return os.WriteFile(RESOLV_CONF, []byte(conf), 0644)
+}
+
+// AddKillSwitch loads an nftables table dropping the output but to link,
+// loopback and allow. The table is flushed and filled in one transaction,
+// so there is no moment without rules when it is replaced.
+func (lr *linuxRoutes) AddKillSwitch(link string, allow []string) error {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "add table %s\n", KILLSWITCH_TABLE)
+	fmt.Fprintf(b, "delete table %s\n", KILLSWITCH_TABLE)
+	fmt.Fprintf(b, "table %s {\n", KILLSWITCH_TABLE)
+	fmt.Fprintf(b, "\tchain output {\n")
+	fmt.Fprintf(b, "\t\ttype filter hook output priority 0; policy drop;\n")
+	fmt.Fprintf(b, "\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(b, "\t\toifname %q accept\n", link)
+	// DHCP and neighbor discovery keep the network up
+	fmt.Fprintf(b, "\t\tudp sport 68 udp dport 67 accept\n")
+	fmt.Fprintf(b, "\t\tudp sport 546 udp dport 547 accept\n")
+	fmt.Fprintf(b, "\t\ticmpv6 type { nd-router-solicit, nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	for _, a := range allow {
+		prefix, err := network.ParsePrefix(a)
+		if err != nil {
+			return err
+		}
+		family := "ip6"
+		if prefix.IP.To4() != nil {
+			family = "ip"
+		}
+		fmt.Fprintf(b, "\t\t%s daddr %s accept\n", family, prefix)
+	}
+	fmt.Fprintf(b, "\t}\n}\n")
+	return runNft(b.String())
+}
+
+func (lr *linuxRoutes) DelKillSwitch() error {
+	return runNft(fmt.Sprintf("delete table %s\n", KILLSWITCH_TABLE))
+}
+
+func (lr *linuxRoutes) Sysctl(key string) (string, error) {
+	b, err := os.ReadFile(SYSCTL_DIR + key)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (lr *linuxRoutes) SetSysctl(key string, value string) error {
+	return os.WriteFile(SYSCTL_DIR+key, []byte(value+"\n"), 0644)
+}
+
+// AddNAT loads an nftables table masquerading subnets out of egress. The
+// replies come back in, new connections from egress to the clients are
+// dropped and the rest of the forwarding is left to the other tables.
+func (lr *linuxRoutes) AddNAT(link string, egress string, subnets []string) error {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "add table %s\n", NAT_TABLE)
+	fmt.Fprintf(b, "delete table %s\n", NAT_TABLE)
+	fmt.Fprintf(b, "table %s {\n", NAT_TABLE)
+	fmt.Fprintf(b, "\tchain forward {\n")
+	fmt.Fprintf(b, "\t\ttype filter hook forward priority 0; policy accept;\n")
+	fmt.Fprintf(b, "\t\tiifname %q oifname %q ct state established,related accept\n", egress, link)
+	fmt.Fprintf(b, "\t\tiifname %q oifname %q drop\n", egress, link)
+	fmt.Fprintf(b, "\t}\n")
+	fmt.Fprintf(b, "\tchain postrouting {\n")
+	fmt.Fprintf(b, "\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	for _, s := range subnets {
+		prefix, err := network.ParsePrefix(s)
+		if err != nil {
+			return err
+		}
+		family := "ip6"
+		if prefix.IP.To4() != nil {
+			family = "ip"
+		}
+		fmt.Fprintf(b, "\t\toifname %q %s saddr %s masquerade\n", egress, family, prefix)
+	}
+	fmt.Fprintf(b, "\t}\n}\n")
+	return runNft(b.String())
+}
+
+func (lr *linuxRoutes) DelNAT() error {
+	return runNft(fmt.Sprintf("delete table %s\n", NAT_TABLE))
+}
+
+func runNft(script string) error {
+	log.Debug(NFT_CMD, "-f -\n"+script)
+	cmd := exec.Command(NFT_CMD, "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("run nft error: %v %s", err, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// useResolved reports whether systemd-resolved manages the resolvers.
+func useResolved() bool {
+	if _, err := exec.LookPath(RESOLVECTL_CMD); err != nil {
+		return false
+	}
+	if _, err := os.Stat(RESOLVED_DIR); err != nil {
+		return false
+	}
+	b, err := os.ReadFile(RESOLV_CONF)
+	return err != nil || !strings.HasPrefix(string(b), RESOLV_HEADER)
+}
@@ -0,0 +1,143 @@
+package vpn
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"prousf/network"
+)
+
+// testVPN is a client with MTU 1400 whose routes go to rec.
+func testVPN(t *testing.T, rec *recordRoutes, conf Config) *VPN {
+	conf.MTU = 1400
+	conf.StateFile = filepath.Join(t.TempDir(), "state")
+	conf.Routes = rec
+	conf.Device = newMemDevice(TUN_NAME, conf.MTU)
+	vpn, err := newVPN(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vpn
+}
+
+func TestSetupRoute(t *testing.T) {
+	rec := newRecordRoutes(
+		network.Route{Dst: "0.0.0.0/0", Gateway: "192.0.2.1", Interface: "eth0"},
+		network.Route{Dst: "::/0", Gateway: "fe80::1", Interface: "eth0"},
+		false,
+	)
+	vpn := testVPN(t, rec, Config{
+		LocalAddr:      "10.8.0.2/24,fd00::2/64",
+		DefaultGateway: "10.8.0.1",
+		Servers:        []Server{{Address: "198.51.100.7:443"}},
+		Proxy:          PROXY_DIRECT,
+		Whitelist:      []string{"203.0.113.0/24"},
+		Blacklist:      []string{"192.0.2.99"},
+		KillSwitch:     true,
+	})
+
+	err := vpn.setupWhitelist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vpn.setupRoute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow := "203.0.113.0/24,198.51.100.7"
+	resolvers, _ := systemResolvers()
+	for _, r := range resolvers {
+		if ip := net.ParseIP(r); ip != nil && !ip.IsLoopback() {
+			allow += "," + ip.String()
+		}
+	}
+	want := []string{
+		"add kill switch dev " + TUN_NAME + " allow " + allow,
+		"set link " + TUN_NAME + " mtu 1400 up",
+		"add address 10.8.0.2/24 dev " + TUN_NAME,
+		"add address fd00::2/64 dev " + TUN_NAME,
+		"add route 203.0.113.0/24 via 192.0.2.1 dev eth0",
+		"add route 198.51.100.7 via 192.0.2.1 dev eth0",
+		"add route 0.0.0.0/1 via 10.8.0.1 dev " + TUN_NAME + " metric 5",
+		"add route 128.0.0.0/1 via 10.8.0.1 dev " + TUN_NAME + " metric 5",
+		"add route ::/1 dev " + TUN_NAME + " metric 5",
+		"add route 8000::/1 dev " + TUN_NAME + " metric 5",
+		"add route 192.0.2.99 via 10.8.0.1 dev " + TUN_NAME + " metric 5",
+	}
+	if !reflect.DeepEqual(rec.Changes, want) {
+		t.Errorf("changes:\n%q\nwant:\n%q", rec.Changes, want)
+	}
+
+	for ip, class := range map[string]network.Class{
+		"203.0.113.5":  network.CLASS_BYPASS,
+		"198.51.100.7": network.CLASS_BYPASS,
+		"1.1.1.1":      network.CLASS_TUNNEL,
+		"2001:db8::1":  network.CLASS_TUNNEL,
+		"192.0.2.99":   network.CLASS_BLOCK,
+	} {
+		if got := vpn.classifier.Lookup(net.ParseIP(ip)); got != class {
+			t.Errorf("class of %s: %d, want %d", ip, got, class)
+		}
+	}
+
+	vpn.journal.revert()
+	if len(rec.Routes) > 0 || len(rec.Addresses[TUN_NAME]) > 0 || rec.KillSwitch != nil {
+		t.Errorf("left after revert: routes %v addresses %v kill switch %v", rec.Routes, rec.Addresses, rec.KillSwitch)
+	}
+}
+
+func TestSetupRouteNoIPv6Gateway(t *testing.T) {
+	rec := newRecordRoutes(network.Route{Dst: "0.0.0.0/0", Gateway: "192.0.2.1", Interface: "eth0"}, network.Route{}, false)
+	vpn := testVPN(t, rec, Config{
+		LocalAddr:      "10.8.0.2/24",
+		DefaultGateway: "10.8.0.1",
+		Proxy:          PROXY_DIRECT,
+		Whitelist:      []string{"2001:db8::7", "198.51.100.7"},
+	})
+
+	err := vpn.setupRoute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := rec.Routes[routeKey(network.Route{Dst: "198.51.100.7"})]; !found {
+		t.Errorf("no bypass route for 198.51.100.7: %v", rec.Routes)
+	}
+	for _, r := range rec.Routes {
+		if network.IsIPv6(r.Dst) {
+			t.Errorf("IPv6 route without an IPv6 network: %v", r)
+		}
+	}
+}
+
+func TestAllowServer(t *testing.T) {
+	rec := newRecordRoutes(network.Route{Dst: "0.0.0.0/0", Gateway: "192.0.2.1", Interface: "eth0"}, network.Route{}, false)
+	vpn := testVPN(t, rec, Config{
+		LocalAddr:      "10.8.0.2/24",
+		DefaultGateway: "10.8.0.1",
+		KillSwitch:     true,
+	})
+
+	// not resolved before the first attempt: allowed, routed with the rest
+	err := vpn.allowServer("198.51.100.7:443", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Routes) > 0 || len(rec.KillSwitch) != 1 || rec.KillSwitch[0] != "198.51.100.7" {
+		t.Errorf("routes %v, kill switch %v", rec.Routes, rec.KillSwitch)
+	}
+
+	// moved once the routes are up
+	err = vpn.allowServer("[2001:db8::7]:443", true)
+	if err == nil {
+		t.Errorf("no error without an IPv6 gateway")
+	}
+	err = vpn.allowServer("198.51.100.8:443", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := rec.Routes[routeKey(network.Route{Dst: "198.51.100.8"})]; !found || len(rec.KillSwitch) != 2 {
+		t.Errorf("routes %v, kill switch %v", rec.Routes, rec.KillSwitch)
+	}
+}
@@ -0,0 +1,200 @@
+package vpn
+
+import (
+	"fmt"
+	"net"
+	"prousf/network"
+	"strconv"
+)
+
+// windowsRoutes uses netsh and route.exe. IPv4 routes on windows always
+// need a gateway, the one of a route through the tunnel is DefaultGateway.
+// IPv6 addresses and routes go through netsh, which takes the interface.
+type windowsRoutes struct{}
+
+func newSystemRoutes() RouteManager {
+	return &windowsRoutes{}
+}
+
+func (wr *windowsRoutes) SetLink(link string, mtu int) error {
+	index, err := linkIndex(link)
+	if err != nil {
+		return err
+	}
+	return runCmd("netsh", "interface", "ipv4", "set", "subinterface", index, fmt.Sprintf("mtu=%d", mtu), "store=active")
+}
+
+func (wr *windowsRoutes) AddAddress(link string, cidr string) error {
+	index, err := linkIndex(link)
+	if err != nil {
+		return err
+	}
+	if network.IsIPv6(cidr) {
+		return runCmd("netsh", "interface", "ipv6", "add", "address", "interface="+index, "address="+cidr, "store=active")
+	}
+	return runCmd("netsh", "interface", "ip", "set", "address", "name="+index, "source=static", "addr="+network.GetIp(cidr), "mask="+network.CIDRToMask(cidr), "gateway=none")
+}
+
+func (wr *windowsRoutes) DelAddress(link string, cidr string) error {
+	index, err := linkIndex(link)
+	if err != nil {
+		return err
+	}
+	if network.IsIPv6(cidr) {
+		return runCmd("netsh", "interface", "ipv6", "delete", "address", "interface="+index, "address="+network.GetIp(cidr))
+	}
+	return runCmd("netsh", "interface", "ip", "delete", "address", "name="+index, "addr="+network.GetIp(cidr))
+}
+
+func (wr *windowsRoutes) AddRoute(r network.Route) error {
+	if network.IsIPv6(r.Dst) {
+		return route6("add", r)
+	}
+	ip, mask, err := routeDst(r)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"add", ip, "mask", mask, r.Gateway}
+	if len(r.Interface) > 0 {
+		index, err := linkIndex(r.Interface)
+		if err != nil {
+			return err
+		}
+		args = append(args, "if", index)
+	}
+	if r.Metric > 0 {
+		args = append(args, "metric", fmt.Sprint(r.Metric))
+	}
+	return runCmd("route", args...)
+}
+
+func (wr *windowsRoutes) DelRoute(r network.Route) error {
+	if network.IsIPv6(r.Dst) {
+		return route6("delete", r)
+	}
+	ip, mask, err := routeDst(r)
+	if err != nil {
+		return err
+	}
+	return runCmd("route", "delete", ip, "mask", mask)
+}
+
+func (wr *windowsRoutes) AddRule(r network.Rule) error {
+	return fmt.Errorf("policy routing is not supported on windows")
+}
+
+func (wr *windowsRoutes) DelRule(r network.Rule) error {
+	return fmt.Errorf("policy routing is not supported on windows")
+}
+
+func (wr *windowsRoutes) DefaultGateway() (network.Route, error) {
+	gw, err := network.GetDefaultGatewayWindows()
+	if err != nil {
+		return network.Route{}, err
+	}
+	return network.Route{Dst: "0.0.0.0/0", Gateway: gw.Gateway}, nil
+}
+
+func (wr *windowsRoutes) DefaultGateway6() (network.Route, error) {
+	gw, err := network.GetDefaultGateway6Windows()
+	if err != nil {
+		return network.Route{}, err
+	}
+	index, err := strconv.Atoi(gw.Interface)
+	if err != nil {
+		return network.Route{}, err
+	}
+	iface, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return network.Route{}, err
+	}
+	return network.Route{Dst: "::/0", Gateway: gw.Gateway, Interface: iface.Name}, nil
+}
+
+func (wr *windowsRoutes) SetDNS(link string, servers []string) error {
+	index, err := linkIndex(link)
+	if err != nil {
+		return err
+	}
+	if len(servers) < 1 {
+		return runCmd("netsh", "interface", "ip", "set", "dns", "name="+index, "source=dhcp")
+	}
+
+	err = runCmd("netsh", "interface", "ip", "set", "dns", "name="+index, "source=static", "addr="+servers[0])
+	if err != nil {
+		return err
+	}
+	for i, s := range servers[1:] {
+		err = runCmd("netsh", "interface", "ip", "add", "dns", "name="+index, "addr="+s, fmt.Sprintf("index=%d", i+2))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wr *windowsRoutes) AddKillSwitch(link string, allow []string) error {
+	return fmt.Errorf("kill switch is not supported on windows")
+}
+
+func (wr *windowsRoutes) DelKillSwitch() error {
+	return fmt.Errorf("kill switch is not supported on windows")
+}
+
+func (wr *windowsRoutes) Sysctl(key string) (string, error) {
+	return "", fmt.Errorf("sysctl is not supported on windows")
+}
+
+func (wr *windowsRoutes) SetSysctl(key string, value string) error {
+	return fmt.Errorf("sysctl is not supported on windows")
+}
+
+func (wr *windowsRoutes) AddNAT(link string, egress string, subnets []string) error {
+	return fmt.Errorf("nat is not supported on windows")
+}
+
+func (wr *windowsRoutes) DelNAT() error {
+	return fmt.Errorf("nat is not supported on windows")
+}
+
+func linkIndex(link string) (string, error) {
+	iface, err := net.InterfaceByName(link)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(iface.Index), nil
+}
+
+// route6 adds or deletes an IPv6 route with netsh, a route without a
+// gateway is on-link.
+func route6(op string, r network.Route) error {
+	prefix, err := network.ParsePrefix(r.Dst)
+	if err != nil {
+		return err
+	}
+	index, err := linkIndex(r.Interface)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"interface", "ipv6", op, "route", "prefix=" + prefix.String(), "interface=" + index}
+	if op == "add" {
+		if len(r.Gateway) > 0 {
+			args = append(args, "nexthop="+r.Gateway)
+		}
+		if r.Metric > 0 {
+			args = append(args, fmt.Sprintf("metric=%d", r.Metric))
+		}
+		args = append(args, "store=active")
+	}
+	return runCmd("netsh", args...)
+}
+
+func routeDst(r network.Route) (string, string, error) {
+	prefix, err := network.ParsePrefix(r.Dst)
+	if err != nil {
+		return "", "", err
+	}
+	return prefix.IP.String(), net.IP(prefix.Mask).String(), nil
+}
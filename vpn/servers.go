@@ -0,0 +1,254 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"prousf/log"
+	"prousf/network"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SELECT_ORDER   = "order"
+	SELECT_LATENCY = "latency"
+
+	PROBE_TIMEOUT = 3 * time.Second
+	DIAL_TIMEOUT  = 10 * time.Second
+	// RFC 8305 connection attempt delay
+	CONNECT_DELAY = 250 * time.Millisecond
+)
+
+type Server struct {
+	Address string // host:port to dial, resolved again on every attempt
+	Domain  string // default Host header and TLS SNI
+	Weight  int
+	Region  string
+
+	latency time.Duration
+}
+
+// rankServers orders the servers by preference: servers of our Region
+// first, then by measured latency (divided by weight) when ServerSelection
+// is "latency", otherwise by weight, keeping the config order for ties.
+func (vpn *VPN) rankServers() []Server {
+	servers := append([]Server(nil), vpn.conf.Servers...)
+	byLatency := vpn.conf.ServerSelection == SELECT_LATENCY && len(servers) > 1
+	if byLatency {
+		for i := range servers {
+			servers[i].latency = probe(servers[i].Address)
+			log.Debug("server", servers[i].Address, "latency", servers[i].latency)
+		}
+	}
+
+	sort.SliceStable(servers, func(i, j int) bool {
+		a, b := servers[i], servers[j]
+		if len(vpn.conf.Region) > 0 && (a.Region == vpn.conf.Region) != (b.Region == vpn.conf.Region) {
+			return a.Region == vpn.conf.Region
+		}
+
+		if byLatency {
+			return a.score() < b.score()
+		}
+		return a.weight() > b.weight()
+	})
+	return servers
+}
+
+func (s Server) weight() int {
+	if s.Weight <= 0 {
+		return 1
+	}
+	return s.Weight
+}
+
+func (s Server) score() time.Duration {
+	return s.latency / time.Duration(s.weight())
+}
+
+// probe returns the time to open a TCP connection to addr, or
+// PROBE_TIMEOUT when it is unreachable.
+func probe(addr string) time.Duration {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, PROBE_TIMEOUT)
+	if err != nil {
+		return PROBE_TIMEOUT
+	}
+	conn.Close()
+	return time.Since(start)
+}
+
+// watchPreferred closes t when it is connected to a fallback server and
+// the preferred one answers again, so the client reconnects to it.
+func (vpn *VPN) watchPreferred(preferred Server, t *tunnel) {
+	if vpn.conf.RecheckInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(vpn.conf.RecheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			if probe(preferred.Address) < PROBE_TIMEOUT {
+				log.Info("Preferred server", preferred.Address, "is back, switching")
+				atomic.StoreInt32(&vpn.switchPreferred, 1)
+				t.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// redirectServer checks the address a going away server sent us to.
+func redirectServer(addr string) (Server, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Server{}, err
+	}
+	return Server{Address: addr, Domain: host}, nil
+}
+
+// resolveServer returns the addresses of s in the order they are dialed,
+// alternating IPv6 and IPv4 like happy eyeballs. When the name cannot be
+// resolved, say the resolver is only reachable through the tunnel that is
+// down, the addresses of the last time are used.
+func (vpn *VPN) resolveServer(s Server) ([]string, error) {
+	host, port, err := net.SplitHostPort(s.Address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{s.Address}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil || len(ips) < 1 {
+		if addrs, found := vpn.resolved[s.Address]; found {
+			log.Debug("resolve", host, "error:", err, "using", addrs)
+			return addrs, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("dns lookup %s not found", host)
+		}
+		return nil, err
+	}
+
+	var v4, v6 []string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, net.JoinHostPort(ip.String(), port))
+		} else {
+			v6 = append(v6, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	first, second := v6, v4
+	if ips[0].To4() != nil {
+		first, second = v4, v6
+	}
+	var addrs []string
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			addrs = append(addrs, first[i])
+		}
+		if i < len(second) {
+			addrs = append(addrs, second[i])
+		}
+	}
+
+	vpn.resolved[s.Address] = addrs
+	return addrs, nil
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialServer connects to the first of addrs to answer. An attempt starts
+// every CONNECT_DELAY, or as soon as the previous one failed, without
+// cancelling the ones still running.
+func dialServer(addrs []string) (net.Conn, error) {
+	if len(addrs) < 1 {
+		return nil, fmt.Errorf("no address to dial")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	dial := func(addr string) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		results <- dialResult{conn: conn, err: err}
+	}
+
+	go dial(addrs[0])
+	started, failed := 1, 0
+	delay := time.NewTimer(CONNECT_DELAY)
+	defer delay.Stop()
+
+	var err error
+	for failed < started {
+		select {
+		case <-delay.C:
+		case r := <-results:
+			if r.err == nil {
+				// the attempts still running are cancelled, close the
+				// ones that connected meanwhile
+				go func(running int) {
+					for i := 0; i < running; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(started - failed - 1)
+				return r.conn, nil
+			}
+			log.Debug("dial", r.err)
+			err = r.err
+			failed++
+		}
+
+		if started < len(addrs) {
+			go dial(addrs[started])
+			started++
+			delay.Reset(CONNECT_DELAY)
+		}
+	}
+	return nil, err
+}
+
+// allowServer adds a server address learned after setupWhitelist to
+// Whitelist and lets it past the kill switch. When routed, the routes are
+// up and it gets its bypass route, else setupRoute adds it with the rest.
+func (vpn *VPN) allowServer(addr string, routed bool) error {
+	dst := network.GetIp(addr)
+	for _, w := range vpn.conf.Whitelist {
+		if w == dst {
+			return nil
+		}
+	}
+
+	if routed {
+		r, err := vpn.bypassRoute(dst)
+		if err != nil {
+			return err
+		}
+		err = vpn.addRoute(r)
+		if err != nil {
+			return err
+		}
+	}
+	vpn.conf.Whitelist = append(vpn.conf.Whitelist, dst)
+
+	if vpn.conf.KillSwitch {
+		return vpn.setKillSwitch()
+	}
+	return nil
+}
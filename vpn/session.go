@@ -0,0 +1,85 @@
+package vpn
+
+import (
+	"net"
+	"net/netip"
+	"prousf/log"
+	"prousf/network"
+)
+
+const (
+	SESSION_HEADER = "X-Session"
+)
+
+// attach makes t the connection of session id. A connection still attached
+// to the session (the client resumed before we noticed the old one died)
+// is closed and its writer stopped.
+func (vpn *VPN) attach(id string, t *tunnel) {
+	vpn.sessionsMu.Lock()
+	old := vpn.sessions[id]
+	vpn.sessions[id] = t
+	vpn.arpTable.Attach(id)
+	vpn.sessionsMu.Unlock()
+
+	if old != nil {
+		log.Debug("replace connection of", id)
+		old.conn.Close()
+		old.finish()
+	}
+}
+
+// detach is called when t is closed. Unless another connection took over,
+// the session is kept for ResumeTimeout before it is deleted.
+func (vpn *VPN) detach(id string, t *tunnel) {
+	vpn.sessionsMu.Lock()
+	defer vpn.sessionsMu.Unlock()
+	if vpn.sessions[id] != t {
+		return
+	}
+	delete(vpn.sessions, id)
+	vpn.release(id, true)
+}
+
+// abort releases a session whose handshake failed before a connection was
+// attached to it.
+func (vpn *VPN) abort(id string, resumed bool) {
+	vpn.sessionsMu.Lock()
+	defer vpn.sessionsMu.Unlock()
+	if vpn.sessions[id] == nil {
+		vpn.release(id, resumed)
+	}
+}
+
+// dropDetached deletes session id when no connection is attached to it. A
+// restarted client has a new key and no ticket, it must not wait out
+// ResumeTimeout to log in again.
+func (vpn *VPN) dropDetached(id string) {
+	vpn.sessionsMu.Lock()
+	defer vpn.sessionsMu.Unlock()
+	if vpn.sessions[id] == nil && vpn.arpTable.IsExist(id) {
+		log.Debug("replace detached session of", id)
+		vpn.arpTable.Delete(id)
+	}
+}
+
+func (vpn *VPN) release(id string, resumable bool) {
+	if resumable && vpn.conf.ResumeTimeout > 0 {
+		vpn.arpTable.Detach(id, vpn.conf.ResumeTimeout)
+	} else {
+		vpn.arpTable.Delete(id)
+	}
+}
+
+// queryUser finds the session of the user ip is an address of. It runs for
+// every packet read from the device and does not allocate.
+func (vpn *VPN) queryUser(ip net.IP) (network.ARPRecord, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return network.ARPRecord{}, false
+	}
+	id, found := vpn.userAddrs[addr.Unmap()]
+	if !found {
+		return network.ARPRecord{}, false
+	}
+	return vpn.arpTable.Query(id)
+}
@@ -0,0 +1,73 @@
+package vpn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"prousf/network"
+)
+
+func TestQueryUser(t *testing.T) {
+	vpn := &VPN{conf: Config{Users: []User{{Name: "a", Pass: "p", IP: "10.8.0.2/24,fd00::2/64"}}}}
+	vpn.setupAuthentication()
+	vpn.arpTable = network.NewARP()
+	record, _ := vpn.arpTable.Update("10.8.0.2", testKey, "")
+
+	for _, ip := range []string{"10.8.0.2", "::ffff:10.8.0.2", "fd00::2"} {
+		got, found := vpn.queryUser(net.ParseIP(ip))
+		if !found || got.Conn != record.Conn {
+			t.Errorf("%s: no session", ip)
+		}
+	}
+	if _, found := vpn.queryUser(net.ParseIP("10.8.0.3")); found {
+		t.Errorf("10.8.0.3: found a session")
+	}
+
+	ip := net.ParseIP("fd00::2")
+	allocs := testing.AllocsPerRun(100, func() {
+		vpn.queryUser(ip)
+	})
+	if allocs > 0 {
+		t.Errorf("%v allocations per lookup", allocs)
+	}
+}
+
+func TestWriterHandover(t *testing.T) {
+	vpn := &VPN{conf: Config{TTL: time.Minute, MTU: 1400}}
+	arp := network.NewARP()
+	record, _ := arp.Update("10.8.0.2", testKey, "")
+	oldPeer, old := tunnelPair(t, tunnelOptions{})
+	newPeer, next := tunnelPair(t, tunnelOptions{})
+
+	go vpn.devToTun(record, old)
+	record.Conn <- []byte{0x45, 0}
+	oldPeer.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := oldPeer.conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client came back on a new connection
+	old.finish()
+	go vpn.devToTun(record, next)
+	const sent = 20
+	for i := 1; i <= sent; i++ {
+		record.Conn <- []byte{0x45, byte(i)}
+	}
+
+	newPeer.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 1; i <= sent; i++ {
+		_, message, err := newPeer.conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("%d of %d packets on the new connection: %v", i-1, sent, err)
+		}
+		packet, err := newPeer.readFrame(message)
+		if err != nil || packet[1] != byte(i) {
+			t.Fatalf("packet %d: %v %v", i, packet, err)
+		}
+	}
+	oldPeer.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := oldPeer.conn.ReadMessage(); err == nil {
+		t.Errorf("the old connection still got packets")
+	}
+}
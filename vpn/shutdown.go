@@ -0,0 +1,137 @@
+package vpn
+
+import (
+	"context"
+	"prousf/log"
+	"prousf/network"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+const (
+	GOAWAY = "goaway"
+	// a draining session is done when nothing was queued for this long
+	DRAIN_IDLE = 200 * time.Millisecond
+)
+
+// shutdown stops the listeners, asks every connected client to go away
+// (to ShutdownRedirect if set) and waits at most DrainTimeout for the
+// sessions to flush their queues and close.
+func (vpn *VPN) shutdown() {
+	if !atomic.CompareAndSwapInt32(&vpn.closing, 0, 1) {
+		return
+	}
+	defer close(vpn.drained)
+	log.Info("Shutting down, draining sessions ...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), vpn.conf.DrainTimeout)
+	defer cancel()
+
+	for _, s := range vpn.httpServers {
+		go s.Shutdown(ctx)
+	}
+
+	vpn.sessionsMu.Lock()
+	for _, t := range vpn.sessions {
+		t.goAway(vpn.conf.ShutdownRedirect)
+	}
+	vpn.sessionsMu.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		vpn.sessionsMu.Lock()
+		left := len(vpn.sessions)
+		vpn.sessionsMu.Unlock()
+		if left < 1 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Info("Drain timeout,", left, "sessions cut")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (vpn *VPN) isClosing() bool {
+	return atomic.LoadInt32(&vpn.closing) == 1
+}
+
+// goAway hands the redirect over to the writer goroutine of t.
+func (t *tunnel) goAway(redirect string) {
+	select {
+	case t.goaway <- redirect:
+	default:
+	}
+}
+
+// drain runs in the writer goroutine: it tells the peer to go away, sends
+// what is queued for it until the queue stays idle for DRAIN_IDLE or
+// DrainTimeout passed, and closes the connection.
+func (vpn *VPN) drain(arpData network.ARPRecord, t *tunnel, redirect string) {
+	c := t.conn
+	defer c.Close()
+
+	msg := strings.TrimSpace(GOAWAY + " " + redirect)
+	err := t.writeText(msg)
+	if err != nil {
+		log.Debug("send goaway error", err)
+		return
+	}
+
+	deadline := time.After(vpn.conf.DrainTimeout)
+	idle := time.NewTimer(DRAIN_IDLE)
+	defer idle.Stop()
+	for queued := true; queued; {
+		select {
+		case message, ok := <-arpData.Conn:
+			if !ok {
+				queued = false
+				break
+			}
+			frame := message
+			if t.opts.Batch {
+				frame = appendPacket(nil, message)
+			}
+			err = t.writeFrame(frame, 1)
+			if err != nil {
+				log.Debug("write dev to tun error", err)
+				return
+			}
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(DRAIN_IDLE)
+		case <-idle.C:
+			queued = false
+		case <-deadline:
+			log.Debug("drain timeout", c.RemoteAddr())
+			queued = false
+		}
+	}
+
+	c.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"),
+		time.Now().Add(time.Second))
+}
+
+// handleGoAway is called by the client reader when the server announced
+// it is going away.
+func (t *tunnel) handleGoAway(redirect string) {
+	t.goneAway = true
+	t.redirect = redirect
+	if len(redirect) > 0 {
+		log.Info("Server is going away, reconnect to", redirect)
+	} else {
+		log.Info("Server is going away")
+	}
+}
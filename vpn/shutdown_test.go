@@ -0,0 +1,50 @@
+package vpn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+
+	"prousf/network"
+)
+
+func TestDrainWaitsForQueue(t *testing.T) {
+	client, server := tunnelPair(t, tunnelOptions{})
+	vpn := &VPN{conf: Config{DrainTimeout: 5 * time.Second}}
+	arpData := network.ARPRecord{Conn: make(chan []byte, 10)}
+
+	// packets still coming from the device while the session drains
+	const sent = 5
+	go func() {
+		for i := 0; i < sent; i++ {
+			time.Sleep(DRAIN_IDLE / 4)
+			arpData.Conn <- []byte{0x45, byte(i)}
+		}
+	}()
+	go vpn.drain(arpData, server, "")
+
+	received := 0
+	for {
+		messType, message, err := client.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Fatal(err)
+			}
+			break
+		}
+		if messType == websocket.TextMessage {
+			continue
+		}
+		frame, err := client.readFrame(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame) > 0 {
+			received++
+		}
+	}
+	if received != sent {
+		t.Errorf("%d of %d packets sent before the close", received, sent)
+	}
+}
@@ -0,0 +1,76 @@
+package vpn
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+type tunnelStats struct {
+	TxPackets uint64
+	RxPackets uint64
+	TxBytes   uint64
+	RxBytes   uint64
+
+	CompressIn  uint64
+	CompressOut uint64
+
+	// round trip time of the last pong, its smoothed average and mean
+	// deviation as in RFC 6298, in nanoseconds
+	RTT    int64
+	SRTT   int64
+	Jitter int64
+}
+
+func (s *tunnelStats) addTx(packets int, bytes int) {
+	atomic.AddUint64(&s.TxPackets, uint64(packets))
+	atomic.AddUint64(&s.TxBytes, uint64(bytes))
+}
+
+func (s *tunnelStats) addRx(packets int, bytes int) {
+	atomic.AddUint64(&s.RxPackets, uint64(packets))
+	atomic.AddUint64(&s.RxBytes, uint64(bytes))
+}
+
+func (s *tunnelStats) addCompress(in int, out int) {
+	atomic.AddUint64(&s.CompressIn, uint64(in))
+	atomic.AddUint64(&s.CompressOut, uint64(out))
+}
+
+func (s *tunnelStats) addRTT(rtt time.Duration) {
+	r := int64(rtt)
+	atomic.StoreInt64(&s.RTT, r)
+
+	srtt := atomic.LoadInt64(&s.SRTT)
+	if srtt == 0 {
+		atomic.StoreInt64(&s.SRTT, r)
+		atomic.StoreInt64(&s.Jitter, r/2)
+		return
+	}
+
+	diff := srtt - r
+	if diff < 0 {
+		diff = -diff
+	}
+	jitter := atomic.LoadInt64(&s.Jitter)
+	atomic.StoreInt64(&s.Jitter, jitter+(diff-jitter)/4)
+	atomic.StoreInt64(&s.SRTT, srtt+(r-srtt)/8)
+}
+
+func (s *tunnelStats) CompressRatio() float64 {
+	in := atomic.LoadUint64(&s.CompressIn)
+	if in == 0 {
+		return 1
+	}
+	return float64(atomic.LoadUint64(&s.CompressOut)) / float64(in)
+}
+
+func (s *tunnelStats) String() string {
+	return fmt.Sprintf("tx %d packets/%d bytes, rx %d packets/%d bytes, compress ratio %.2f, rtt %v (avg %v, jitter %v)",
+		atomic.LoadUint64(&s.TxPackets), atomic.LoadUint64(&s.TxBytes),
+		atomic.LoadUint64(&s.RxPackets), atomic.LoadUint64(&s.RxBytes),
+		s.CompressRatio(),
+		time.Duration(atomic.LoadInt64(&s.RTT)),
+		time.Duration(atomic.LoadInt64(&s.SRTT)),
+		time.Duration(atomic.LoadInt64(&s.Jitter)))
+}
@@ -0,0 +1,148 @@
+package vpn
+
+import (
+	"prousf/crypto"
+	"prousf/log"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// tunnel is one websocket connection together with everything negotiated
+// for it. Frames go through the layers in this order on the way out:
+// batch, compress, pad, encrypt.
+type tunnel struct {
+	conn  *websocket.Conn
+	key   []byte
+	opts  tunnelOptions
+	stats *tunnelStats
+
+	compressor *compressor
+	obfs       *obfuscator
+	lastWrite  time.Time
+
+	done      chan struct{} // closed when the connection is finished
+	closeDone sync.Once
+
+	pings          chan string // timestamps of pings waiting for a pong
+	missedPongs    int32
+	maxMissedPongs int
+
+	goaway   chan string // set by shutdown, handled by the writer
+	goneAway bool        // the peer announced it is going away
+	redirect string      // where the peer told us to reconnect
+}
+
+func newTunnel(c *websocket.Conn, key []byte, opts tunnelOptions, maxMissedPongs int) *tunnel {
+	t := &tunnel{
+		conn:  c,
+		key:   key,
+		opts:  opts,
+		stats: new(tunnelStats),
+		done:  make(chan struct{}),
+
+		pings:          make(chan string, 4),
+		maxMissedPongs: maxMissedPongs,
+
+		goaway: make(chan string, 1),
+	}
+
+	if len(opts.Compress) > 0 {
+		t.compressor = newCompressor(opts.Compress, t.stats)
+	}
+
+	if len(opts.Obfs) > 0 {
+		t.obfs = newObfuscator(opts.Obfs)
+	}
+	return t
+}
+
+// finish closes done, which stops the writer of t.
+func (t *tunnel) finish() {
+	t.closeDone.Do(func() {
+		close(t.done)
+	})
+}
+
+func (t *tunnel) writeFrame(frame []byte, packets int) error {
+	if t.compressor != nil {
+		frame = t.compressor.compress(frame)
+	}
+
+	if t.obfs != nil {
+		frame = t.obfs.pad(frame)
+	}
+
+	return t.write(frame, packets)
+}
+
+// writeText sends a keepalive or goaway message, padded like the data when
+// the tunnel is obfuscated.
+func (t *tunnel) writeText(msg string) error {
+	if t.obfs != nil {
+		return t.write(t.obfs.padText([]byte(msg)), 0)
+	}
+	return t.conn.WriteMessage(websocket.TextMessage, []byte(msg))
+}
+
+// jitter is the random delay added to the next flush or cover frame.
+func (t *tunnel) jitter() time.Duration {
+	if t.obfs == nil {
+		return 0
+	}
+	return t.obfs.delay()
+}
+
+// writeCover sends a frame without payload that the peer drops.
+func (t *tunnel) writeCover() error {
+	return t.write(t.obfs.cover(), 0)
+}
+
+// coverInterval is how long the tunnel may stay idle before a cover frame
+// is sent, 0 if the profile has no cover traffic.
+func (t *tunnel) coverInterval() time.Duration {
+	if t.obfs == nil {
+		return 0
+	}
+	return t.obfs.profile.Cover
+}
+
+func (t *tunnel) write(frame []byte, packets int) error {
+	dataEn, err := crypto.AESEncrypt(t.key, frame)
+	if err != nil {
+		log.Debug("encrypt data error", err)
+		return nil
+	}
+
+	t.stats.addTx(packets, len(dataEn))
+	t.lastWrite = time.Now()
+	return t.conn.WriteMessage(websocket.BinaryMessage, dataEn)
+}
+
+func (t *tunnel) readFrame(message []byte) ([]byte, error) {
+	frame, err := crypto.AESDecrypt(t.key, message)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.obfs != nil {
+		var text bool
+		frame, text, err = unpad(frame)
+		if err != nil || len(frame) < 1 {
+			return nil, err
+		}
+		if text {
+			t.handleText(frame)
+			return nil, nil
+		}
+	}
+
+	if len(t.opts.Compress) > 0 {
+		frame, err = decompress(t.opts.Compress, frame)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return frame, nil
+}
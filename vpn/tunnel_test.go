@@ -0,0 +1,39 @@
+package vpn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fasthttp/websocket"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// tunnelPair returns the two ends of a websocket connection, as tunnels
+// with the same options.
+func tunnelPair(tb testing.TB, opts tunnelOptions) (*tunnel, *tunnel) {
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			tb.Error(err)
+			return
+		}
+		conns <- c
+	}))
+	tb.Cleanup(srv.Close)
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := <-conns
+	tb.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return newTunnel(c, testKey, opts, 0), newTunnel(s, testKey, opts, 0)
+}
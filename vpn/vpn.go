@@ -1,14 +1,17 @@
 package vpn
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/exec"
@@ -20,6 +23,8 @@ import (
 	"prousf/utils"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -30,8 +35,10 @@ type Config struct {
 	MTU            int
 	TTL            time.Duration
 	ServerAddr     string
+	ServerName     string
 	LocalAddr      string
 	HostHeader     string
+	ALPN           []string
 	DefaultGateway string
 	IsServer       bool
 	Whitelist      []string
@@ -44,6 +51,63 @@ type Config struct {
 	SSLCrt string
 
 	RedirectGateway string
+
+	BatchSize  int
+	BatchDelay time.Duration
+	Compress   string
+
+	Proxy       string
+	Obfuscation string
+
+	TunnelPath  string
+	VersionPath string
+	AuthHeader  string
+	Decoy       string
+
+	PathPrefix     string
+	TrustedProxies []string
+	ProxyProtocol  bool
+
+	Listeners []Listener
+
+	ResumeTimeout time.Duration
+
+	Servers         []Server
+	ServerSelection string
+	Region          string
+	RecheckInterval time.Duration
+
+	RetryMin   time.Duration
+	RetryMax   time.Duration
+	MaxRetries int
+
+	MissedPongs int
+
+	DrainTimeout     time.Duration
+	ShutdownRedirect string
+
+	MSS int
+
+	StateFile string
+	DryRun    bool
+
+	Domains     []string
+	DomainTTL   time.Duration
+	DNSListen   string
+	DNSUpstream string
+
+	DNS          []string
+	DNSIntercept bool
+
+	KillSwitch bool
+
+	NAT          bool
+	NATInterface string
+
+	// Routes and Device replace the ones of the system when set, to run
+	// without privileges
+	Routes RouteManager
+	Device tun.Device
 }
 
 type User struct {
@@ -58,26 +122,49 @@ type VPN struct {
 	dev       tun.Device
 	arpTable  *network.ARP
 	userTable map[string]User
-	blackList map[string]bool
-	myNetwork *net.IPNet
-	myIP      net.IP
-	tryNumber int
+	// blacklist, whitelist and routes by longest prefix
+	classifier *network.Classifier
+	// the addresses of the users, dual-stack users have one per family,
+	// mapped to the id of their session
+	userAddrs  map[netip.Addr]string
+	myNetworks []*net.IPNet
+	myIP       net.IP
+	tryNumber  int
+	decoy      http.Handler
+	mss        int
+	journal    *journal
+	routes     RouteManager
+
+	trustedProxies []*net.IPNet
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*tunnel
+	sessionKey []byte
+	ticket     string
+
+	server          Server
+	resolved        map[string][]string
+	switchPreferred int32
+	goaway          bool
+	redirect        string
+	dnsServers      []string
+	resolvers       []string
+	forwarder       *dnsForwarder
+
+	httpServers []*http.Server
+	closing     int32
+	drained     chan struct{}
 
 	inMyNetwork func(ip net.IP) bool
 	checkUpdate func(string, string, string) string
-	queryArp    func(ip string) (network.ARPRecord, bool)
+	queryArp    func(ip net.IP) (network.ARPRecord, bool)
 }
 
 const (
 	TUN_NAME = "MyNIC"
 
-	TIME_TO_TRY = 5 * time.Second
-	MAX_TRY     = 10
-
-	WEBSOCKET_PATH              = "/home"
-	VERSION_PATH                = "/version"
-	AUTHEN_HEADER               = "Cookie"
 	USERAGENT                   = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/112.0.0.0 Safari/537.3"
+	ERROR_HEADER                = "X-Error"
 	ERROR_AUTHENTICATION_FAILED = "Authentication failed"
 	ERROR_LOGGED_ANOTHER        = "You have logged in at another location"
 
@@ -89,23 +176,73 @@ var (
 	YOUR_OS = runtime.GOOS
 )
 
-func Create(conf Config) (vpn *VPN, err error) {
-	vpn = new(VPN)
+// newVPN parses conf and prepares the routes, the journal and the device,
+// everything Create needs before it starts.
+func newVPN(conf Config) (*VPN, error) {
+	var err error
+	vpn := new(VPN)
 	vpn.conf = conf
-	vpn.blackList = make(map[string]bool, 0)
-	vpn.myIP, vpn.myNetwork, err = net.ParseCIDR(vpn.conf.LocalAddr)
-	if err != nil {
-		return
+	vpn.classifier = network.NewClassifier()
+	vpn.sessions = make(map[string]*tunnel, 0)
+	vpn.resolved = make(map[string][]string, 0)
+	vpn.drained = make(chan struct{})
+	vpn.mss = vpn.conf.MSS
+	if vpn.mss == 0 {
+		vpn.mss = network.MSSForMTU(vpn.conf.MTU)
+	}
+	for _, addr := range network.SplitAddresses(vpn.conf.LocalAddr) {
+		ip, myNetwork, err := net.ParseCIDR(addr)
+		if err != nil {
+			return vpn, err
+		}
+		if vpn.myIP == nil {
+			vpn.myIP = ip
+		}
+		vpn.myNetworks = append(vpn.myNetworks, myNetwork)
+	}
+	if vpn.myIP == nil {
+		return vpn, fmt.Errorf("no address")
 	}
 
+	vpn.routes = vpn.conf.Routes
+	if vpn.routes == nil {
+		vpn.routes = newSystemRoutes()
+	}
+	if vpn.conf.DryRun && vpn.conf.Routes == nil {
+		gateway, _ := vpn.routes.DefaultGateway()
+		gateway6, _ := vpn.routes.DefaultGateway6()
+		vpn.routes = newRecordRoutes(gateway, gateway6, true)
+	}
+	if len(vpn.conf.StateFile) < 1 {
+		vpn.conf.StateFile = defaultStatePath(vpn.conf.IsServer)
+	}
+	vpn.journal = openJournal(vpn.conf.StateFile, vpn.routes, vpn.conf.DryRun)
+
 	log.Debug("Create Virtual Network Adapter")
-	vpn.dev, err = tun.CreateTUN(TUN_NAME, vpn.conf.MTU)
+	vpn.dev = vpn.conf.Device
+	if vpn.dev != nil {
+		return vpn, nil
+	}
+	if vpn.conf.DryRun {
+		vpn.dev = newMemDevice(TUN_NAME, vpn.conf.MTU)
+	} else {
+		vpn.dev, err = tun.CreateTUN(TUN_NAME, vpn.conf.MTU)
+		if err != nil {
+			return vpn, err
+		}
+	}
+	return vpn, nil
+}
+
+func Create(conf Config) (vpn *VPN, err error) {
+	vpn, err = newVPN(conf)
 	if err != nil {
 		return
 	}
 	defer vpn.stop()
 
 	log.Debug("Make ARP Table")
+
 	vpn.arpTable = network.NewARP()
 
 	log.Debug("Setup Authentication")
@@ -114,30 +251,106 @@ func Create(conf Config) (vpn *VPN, err error) {
 	vpn.captureDev()
 
 	if vpn.conf.IsServer { //is server mode
-		vpn.queryArp = vpn.arpTable.Query
+		vpn.queryArp = vpn.queryUser
 		vpn.inMyNetwork = func(ip net.IP) bool {
-			return vpn.myNetwork.Contains(ip)
+			for _, n := range vpn.myNetworks {
+				if n.Contains(ip) {
+					return true
+				}
+			}
+			return false
 		}
 
 		vpn.startServer()
 	} else { // is client mode
 		again := false
-		vpn.queryArp = vpn.arpTable.QueryOne
+		vpn.queryArp = func(ip net.IP) (network.ARPRecord, bool) {
+			return vpn.arpTable.QueryOne()
+		}
+
+		if len(vpn.conf.Servers) < 1 {
+			vpn.conf.Servers = []Server{{Address: vpn.conf.ServerAddr}}
+		}
+		servers := vpn.rankServers()
+		current := 0
+
+		netChanges, err := network.WatchChanges(TUN_NAME)
+		if err != nil {
+			log.Error("watch network changes error:", err)
+		}
+		retry := newBackoff(vpn.conf.RetryMin, vpn.conf.RetryMax)
+
+		err = vpn.setupWhitelist()
+		if err != nil {
+			return vpn, fmt.Errorf("setup whitelist error: %v", err)
+		}
 
 		for {
-			vpn.tryNumber++
-			if vpn.tryNumber >= MAX_TRY {
-				break
+			if vpn.server.Address != servers[current].Address {
+				vpn.ticket = ""
 			}
+			vpn.server = servers[current]
+			atomic.StoreInt32(&vpn.switchPreferred, 0)
 
-			vpn.startClient(again)
-			again = true
-			vpn.arpTable.Delete(vpn.myIP.String())
-			log.Info(fmt.Sprintf("Try again(%d/%d) in ", vpn.tryNumber+1, MAX_TRY), TIME_TO_TRY, "...")
-			if vpn.tryNumber > 0 {
-				time.Sleep(TIME_TO_TRY)
+			var connected bool
+			connected, err = vpn.startClient(again, servers[0])
+			again = again || connected
+			if err != nil {
+				if isFatal(err) {
+					return vpn, err
+				}
+				log.Error(err)
+			}
+
+			if atomic.LoadInt32(&vpn.switchPreferred) == 1 {
+				current = 0
+				continue
+			}
+
+			// the server is shutting down, move on without waiting
+			if vpn.goaway {
+				vpn.goaway = false
+				current = (current + 1) % len(servers)
+				if len(vpn.redirect) > 0 {
+					target, err := redirectServer(vpn.redirect)
+					if err != nil {
+						log.Error("redirect error:", err)
+					} else {
+						servers = append([]Server{target}, vpn.rankServers()...)
+						current = 0
+					}
+				}
+				vpn.tryNumber = 0
+				retry.reset()
+				continue
 			}
 
+			if connected {
+				vpn.tryNumber = 0
+				retry.reset()
+			} else {
+				// fail over to the next server at once, wait only when
+				// every server failed
+				current++
+				if current < len(servers) {
+					continue
+				}
+				servers = vpn.rankServers()
+				current = 0
+			}
+
+			vpn.tryNumber++
+			if vpn.conf.MaxRetries > 0 && vpn.tryNumber > vpn.conf.MaxRetries {
+				return vpn, fmt.Errorf("give up after %d retries, last error: %v", vpn.conf.MaxRetries, err)
+			}
+
+			wait := retry.next()
+			log.Info(fmt.Sprintf("Try again(%d) in ", vpn.tryNumber), wait, "...")
+			select {
+			case <-time.After(wait):
+			case <-netChanges:
+				log.Info("Network changed, try again now")
+			}
 		}
 	}
 	return
@@ -147,70 +360,161 @@ func (vpn *VPN) startServer() {
 	var upgrader = websocket.Upgrader{}
 
 	handlerClient := func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get(AUTHEN_HEADER)
+		if vpn.isClosing() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		token := r.Header.Get(vpn.conf.AuthHeader)
 		idRequest, key := vpn.authenConn(token)
 
-		if len(idRequest) < 1 {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(ERROR_AUTHENTICATION_FAILED))
-			log.Debug(r.RemoteAddr, ERROR_AUTHENTICATION_FAILED)
+		if len(idRequest) < 1 || !websocket.IsWebSocketUpgrade(r) {
+			// a configured user learns the password is wrong, even behind
+			// the decoy, which keeps answering anyone else
+			if vpn.isUser(token) {
+				w.Header().Set(ERROR_HEADER, ERROR_AUTHENTICATION_FAILED)
+			}
+			vpn.reject(w, r, http.StatusUnauthorized, ERROR_AUTHENTICATION_FAILED)
+			log.Debug(vpn.clientIP(r), ERROR_AUTHENTICATION_FAILED)
 			return
 		}
 
-		if vpn.arpTable.IsExist(idRequest) {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(ERROR_LOGGED_ANOTHER))
-			log.Debug(idRequest, ERROR_LOGGED_ANOTHER)
-			return
+		arpData, resumed := vpn.arpTable.Resume(idRequest, key, r.Header.Get(SESSION_HEADER))
+		if !resumed {
+			vpn.dropDetached(idRequest)
+			if vpn.arpTable.IsExist(idRequest) {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(ERROR_LOGGED_ANOTHER))
+				log.Debug(idRequest, vpn.clientIP(r), ERROR_LOGGED_ANOTHER)
+				return
+			}
+			arpData, _ = vpn.arpTable.Update(idRequest, key, utils.GenUUID())
 		}
 
-		c, err := upgrader.Upgrade(w, r, nil)
+		opts := vpn.acceptOptions(parseOptions(r.Header.Get(OPTIONS_HEADER)))
+		header := http.Header{
+			OPTIONS_HEADER: []string{opts.String()},
+			SESSION_HEADER: []string{arpData.Ticket},
+		}
+		if len(vpn.conf.DNS) > 0 {
+			header.Set(DNS_HEADER, strings.Join(vpn.conf.DNS, ","))
+		}
+		c, err := upgrader.Upgrade(w, r, header)
 		if err != nil {
 			log.Error("Upgrade socket error:", err)
+			vpn.abort(idRequest, resumed)
 			return
 		}
+		if resumed {
+			log.Info("client", idRequest, "resumed from", vpn.clientIP(r))
+		} else {
+			log.Info("client", idRequest, "connected from", vpn.clientIP(r))
+		}
+
+		t := newTunnel(c, key, opts, vpn.conf.MissedPongs)
+		vpn.attach(idRequest, t)
 		defer func() {
 			c.Close()
-			vpn.arpTable.Delete(idRequest)
-			log.Debug("close client", idRequest)
+			t.finish()
+			vpn.detach(idRequest, t)
+			log.Debug("close client", idRequest, t.stats)
 		}()
 
-		arpData, _ := vpn.arpTable.Update(idRequest, key)
+		go vpn.devToTun(arpData, t)
+		vpn.tunToDev(t)
+	}
 
-		go vpn.devToTun(arpData, c)
-		vpn.tunToDev(key, c)
+	err := vpn.setupTrustedProxies()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(vpn.conf.Decoy) > 0 {
+		decoy, err := newDecoy(vpn.conf.Decoy)
+		if err != nil {
+			panic(err)
+		}
+		vpn.decoy = decoy
+	}
+
+	handler := func(l Listener) http.Handler {
+		mux := http.NewServeMux()
+		if l.allowTransport(TRANSPORT_WEBSOCKET) {
+			mux.HandleFunc(vpn.conf.TunnelPath, handlerClient)
+		}
+		// the version would give away what hides behind the decoy
+		if vpn.decoy == nil {
+			mux.HandleFunc(vpn.conf.VersionPath, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(VERSION))
+			})
+		}
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			vpn.reject(w, r, http.StatusNotFound, "404 page not found\n")
+		})
+		return vpn.withPrefix(vpn.conf.PathPrefix, mux)
 	}
 
-	http.HandleFunc(WEBSOCKET_PATH, handlerClient)
-	http.HandleFunc(VERSION_PATH, func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(VERSION))
-	})
 	log.Debug("Route Network")
-	err := vpn.setupRoute()
+	err = vpn.setupRoute()
 	if err != nil {
 		panic(err)
 	}
+
+	listeners := vpn.conf.Listeners
+	if len(listeners) < 1 {
+		listeners = []Listener{{
+			Address:       vpn.conf.ServerAddr,
+			SSL:           vpn.conf.SSL,
+			SSLCrt:        vpn.conf.SSLCrt,
+			SSLKey:        vpn.conf.SSLKey,
+			ProxyProtocol: vpn.conf.ProxyProtocol,
+		}}
+	}
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		ln, err := vpn.listen(l)
+		if err != nil {
+			panic(err)
+		}
+
+		server := &http.Server{
+			Handler: handler(l),
+		}
+		vpn.httpServers = append(vpn.httpServers, server)
+
+		wg.Add(1)
+		go func(l Listener) {
+			defer wg.Done()
+			log.Info("Listen:", l)
+			err := server.Serve(ln)
+			if err != http.ErrServerClosed {
+				log.Error(err)
+			}
+		}(l)
+	}
+
 	log.Info("VPN Server started successfully!")
 	log.Info("Version:", VERSION, "-", RELEASE)
-	if vpn.conf.SSL {
-		log.Info("Listen:", vpn.conf.ServerAddr, "- SSL")
-		log.Error(http.ListenAndServeTLS(vpn.conf.ServerAddr, vpn.conf.SSLCrt, vpn.conf.SSLKey, nil))
-	} else {
-		log.Info("Listen:", vpn.conf.ServerAddr, "- No SSL")
-		log.Error(http.ListenAndServe(vpn.conf.ServerAddr, nil))
+	wg.Wait()
+	if vpn.isClosing() {
+		<-vpn.drained
 	}
 
 }
 
-func (vpn *VPN) startClient(again bool) {
-	var keyByte = []byte(utils.GenUUID())
+func (vpn *VPN) startClient(again bool, preferred Server) (connected bool, err error) {
+	// the key lives as long as the process so the session can be resumed
+	if vpn.sessionKey == nil {
+		vpn.sessionKey = []byte(utils.GenUUID())
+	}
+	var keyByte = vpn.sessionKey
 	var tokenUser string
 	for k, v := range vpn.userTable {
 		tokenByte, err := crypto.AESEncrypt([]byte(v.Pass), keyByte)
 		if err != nil {
-			log.Error("encrypt key error", err)
-			return
+			return false, fatal(fmt.Errorf("encrypt key error: %v", err))
 		}
 		tokenUser = k + ":" + base64.StdEncoding.EncodeToString(tokenByte)
 		break
@@ -228,38 +532,81 @@ func (vpn *VPN) startClient(again bool) {
 	if vpn.conf.SSL {
 		scheme = "wss"
 	}
-	u := url.URL{Scheme: scheme, Host: vpn.conf.ServerAddr, Path: WEBSOCKET_PATH}
+	u := url.URL{Scheme: scheme, Host: vpn.server.Address, Path: vpn.conf.TunnelPath}
 
 	headerReq := http.Header{
-		AUTHEN_HEADER: []string{tokenUser},
-		"User-Agent":  []string{USERAGENT},
+		OPTIONS_HEADER: []string{vpn.wantOptions().String()},
+		"User-Agent":   []string{USERAGENT},
+	}
+	headerReq.Set(vpn.conf.AuthHeader, tokenUser)
+	if len(vpn.ticket) > 0 {
+		headerReq.Set(SESSION_HEADER, vpn.ticket)
 	}
 
-	if len(vpn.conf.HostHeader) > 0 {
-		headerReq["Host"] = []string{vpn.conf.HostHeader}
+	hostHeader := vpn.conf.HostHeader
+	if len(hostHeader) < 1 {
+		hostHeader = vpn.server.Domain
+	}
+	if ip := net.ParseIP(hostHeader); ip != nil && ip.To4() == nil {
+		hostHeader = "[" + hostHeader + "]"
+	}
+	if len(hostHeader) > 0 {
+		headerReq["Host"] = []string{hostHeader}
 	}
 
-	dialer := websocket.Dialer{}
+	proxy, err := vpn.proxyFunc()
+	if err != nil {
+		return false, fatal(err)
+	}
+
+	addrs, err := vpn.resolveServer(vpn.server)
+	if err != nil {
+		return false, err
+	}
+	// the server may have moved since the whitelist was made, or could
+	// not be resolved then
+	for _, addr := range addrs {
+		err = vpn.allowServer(addr, again)
+		if err != nil {
+			log.Error("allow server error:", err)
+		}
+	}
+
+	dialer := websocket.Dialer{
+		Proxy: proxy,
+		NetDialContext: func(ctx context.Context, proto, addr string) (net.Conn, error) {
+			// a proxy is dialed as usual and resolves the server itself
+			if addr != u.Host {
+				var d net.Dialer
+				return d.DialContext(ctx, proto, addr)
+			}
+			return dialServer(addrs)
+		},
+	}
 	if vpn.conf.SSL {
 		caCert, err := ioutil.ReadFile(vpn.conf.SSLCrt)
 		if err != nil {
-			log.Error("Error opening cert file "+vpn.conf.SSLCrt+", error:", err)
-			return
+			return false, fatal(fmt.Errorf("error opening cert file %s: %v", vpn.conf.SSLCrt, err))
 		}
 		caCertPool := x509.NewCertPool()
 		caCertPool.AppendCertsFromPEM(caCert)
 
+		serverName := vpn.conf.ServerName
+		if len(serverName) < 1 {
+			serverName = vpn.server.Domain
+		}
+
 		tlsConfig := &tls.Config{
 			RootCAs:            caCertPool,
 			InsecureSkipVerify: true,
+			ServerName:         serverName,
+			NextProtos:         vpn.conf.ALPN,
 		}
 
-		dialer = websocket.Dialer{
-			TLSClientConfig: tlsConfig,
-		}
+		dialer.TLSClientConfig = tlsConfig
 	}
 
-	c, resp, err := dialer.Dial(u.String(), headerReq)
+	c, resp, err = dialer.Dial(u.String(), headerReq)
 	if err != nil {
 		var b []byte
 		if resp != nil {
@@ -268,42 +615,83 @@ func (vpn *VPN) startClient(again bool) {
 			}()
 			b, _ = io.ReadAll(resp.Body)
 		}
-		log.Error(fmt.Sprintf("dial %s error: %s \n%s", u.String(), err.Error(), string(b)))
-		return
+		err = fmt.Errorf("dial %s error: %s \n%s", u.String(), err.Error(), string(b))
+
+		// wrong credentials won't get better, a session still open on
+		// the server will time out
+		if resp != nil && (resp.Header.Get(ERROR_HEADER) == ERROR_AUTHENTICATION_FAILED ||
+			resp.StatusCode == http.StatusUnauthorized && string(b) == ERROR_AUTHENTICATION_FAILED) {
+			err = fatal(err)
+		}
+		return false, err
 	}
 
 	defer func() {
 		c.Close()
 	}()
 
+	opts := parseOptions(resp.Header.Get(OPTIONS_HEADER))
+	log.Debug("Tunnel options:", opts)
+	vpn.ticket = resp.Header.Get(SESSION_HEADER)
+
 	if !again {
 		log.Debug("Route Network")
 		err = vpn.setupRoute()
 		if err != nil {
-			log.Error("setup route error", err)
-			return
+			return false, fatal(fmt.Errorf("setup route error: %v", err))
 		}
+
+		// the routes it adds need the tun configured
+		if len(vpn.conf.Domains) > 0 {
+			err = vpn.startDNSForwarder()
+			if err != nil {
+				return false, fatal(fmt.Errorf("start DNS forwarder error: %v", err))
+			}
+		}
+	}
+
+	err = vpn.applyDNS(resp.Header.Get(DNS_HEADER))
+	if err != nil {
+		log.Error("setup DNS error:", err)
 	}
 
 	log.Info("VPN Client started successfully!")
 	log.Info("Version:", VERSION, "-", RELEASE)
-	vpn.tryNumber = 0
+	log.Info("Server:", vpn.server.Address, vpn.server.Region)
 	// if !again {
 	// scheme := "http://"
 	// if vpn.conf.SSL {
 	// 	scheme = "https://"
 	// }
-	// fmt.Print(vpn.checkUpdate(scheme+vpn.conf.ServerAddr+VERSION_PATH, VERSION, vpn.conf.HostHeader))
+	// fmt.Print(vpn.checkUpdate(scheme+vpn.conf.ServerAddr+vpn.conf.VersionPath, VERSION, vpn.conf.HostHeader))
 	// }
 
-	arpData, _ := vpn.arpTable.Update(vpn.myIP.String(), keyByte)
-	go vpn.devToTun(arpData, c)
-	vpn.tunToDev(keyByte, c)
+	// packets captured while reconnecting are still queued in the record
+	arpData, found := vpn.arpTable.Query(vpn.myIP.String())
+	if !found {
+		arpData, _ = vpn.arpTable.Update(vpn.myIP.String(), keyByte, vpn.ticket)
+	}
+	t := newTunnel(c, keyByte, opts, vpn.conf.MissedPongs)
+	defer func() {
+		t.finish()
+		log.Info("Tunnel closed:", t.stats)
+	}()
+	if preferred.Address != vpn.server.Address {
+		go vpn.watchPreferred(preferred, t)
+	}
+	go vpn.devToTun(arpData, t)
+	vpn.tunToDev(t)
+	if t.goneAway {
+		vpn.goaway = true
+		vpn.redirect = t.redirect
+	}
+	return true, nil
 }
 
-func (vpn *VPN) tunToDev(key []byte, c *websocket.Conn) {
+func (vpn *VPN) tunToDev(t *tunnel) {
+	c := t.conn
 	for {
-		c.SetReadDeadline(time.Now().Add(vpn.conf.TTL * 4 / 3))
+		c.SetReadDeadline(time.Now().Add(t.readTimeout(vpn.conf.TTL)))
 		messType, message, err := c.ReadMessage()
 		if err != nil {
 			log.Error("read message from tun error:", err)
@@ -312,13 +700,18 @@ func (vpn *VPN) tunToDev(key []byte, c *websocket.Conn) {
 
 		switch messType {
 		case websocket.TextMessage:
+			t.handleText(message)
 		default:
-			rawData, err := crypto.AESDecrypt(key, message)
+			rawData, err := t.readFrame(message)
 			if err != nil {
 				log.Debug("decrypt data error", err)
 				return
 			}
 
+			if len(rawData) < 1 {
+				continue
+			}
+
 			// header := network.ParseHeaderPacket(rawData)
 			// if vpn.conf.IsServer {
 			// 	if !vpn.myIP.Equal(header.IPDst) && vpn.arpTable.IsExist(header.IPDst.String()) {
@@ -341,7 +734,17 @@ func (vpn *VPN) tunToDev(key []byte, c *websocket.Conn) {
 			// 	}
 			// }
 
-			_, err = vpn.dev.Write(rawData, 0)
+			packets := 1
+			if t.opts.Batch {
+				packets = 0
+				err = splitPackets(rawData, func(packet []byte) error {
+					packets++
+					return vpn.writeDev(packet)
+				})
+			} else {
+				err = vpn.writeDev(rawData)
+			}
+			t.stats.addRx(packets, len(message))
 			if err != nil {
 				log.Debug("write tun to dev error", err)
 				return
@@ -367,67 +770,193 @@ func (vpn *VPN) captureDev() {
 			packet := buf[:n]
 
 			header := network.ParseHeaderPacket(packet)
-			if vpn.blackList[header.IPDst.String()] {
+			if vpn.classifier.Lookup(header.IPDst) == network.CLASS_BLOCK {
 				log.Debug("Block ip", header.IPDst)
 				continue
 			}
 
-			c, ok := vpn.queryArp(header.IPDst.String())
+			c, ok := vpn.queryArp(header.IPDst)
 			if !ok {
 				continue
 			}
 
-			dataEn, err := crypto.AESEncrypt(c.Key, packet)
-			if err != nil {
-				log.Debug("encrypt data error", err)
-				continue
+			if vpn.mss > 0 {
+				network.ClampMSS(packet, vpn.mss)
 			}
 
-			c.Conn <- dataEn
+			// never block here: one session waiting to be resumed must
+			// not stall the others
+			select {
+			case c.Conn <- append([]byte(nil), packet...):
+			default:
+				log.Trace("queue full, drop packet to", header.IPDst)
+			}
 
 		}
 	}()
 }
 
-func (vpn *VPN) devToTun(arpData network.ARPRecord, c *websocket.Conn) {
+func (vpn *VPN) writeDev(packet []byte) error {
+	if vpn.mss > 0 {
+		network.ClampMSS(packet, vpn.mss)
+	}
+	_, err := vpn.dev.Write(packet, 0)
+	return err
+}
+
+func (vpn *VPN) devToTun(arpData network.ARPRecord, t *tunnel) {
+	c := t.conn
+	// the writer of the previous connection of the session must not take
+	// packets from the queue anymore
+	if arpData.Writer != nil {
+		arpData.Writer.Lock()
+		defer arpData.Writer.Unlock()
+	}
+	select {
+	case <-t.done:
+		return
+	default:
+	}
 	ticker := time.NewTicker(vpn.conf.TTL)
+	flush := time.NewTimer(vpn.conf.BatchDelay)
+	flush.Stop()
+	var cover <-chan time.Time
+	var coverTimer *time.Timer
+	if interval := t.coverInterval(); interval > 0 {
+		coverTimer = time.NewTimer(interval + t.jitter())
+		defer coverTimer.Stop()
+		cover = coverTimer.C
+	}
 	defer func() {
 		log.Debug("quit dev to tun", c.LocalAddr(), c.RemoteAddr())
 		ticker.Stop()
+		flush.Stop()
 	}()
 
+	var batch []byte
+	var batched int
+	if t.opts.Batch {
+		batch = make([]byte, 0, vpn.conf.BatchSize+BATCH_HEADER_LEN+vpn.conf.MTU)
+	}
+	sendBatch := func() error {
+		flush.Stop()
+		if len(batch) < 1 {
+			return nil
+		}
+		err := t.writeFrame(batch, batched)
+		batch = batch[:0]
+		batched = 0
+		return err
+	}
+
 	for {
 		select {
+		case <-t.done:
+			return
 		case message, ok := <-arpData.Conn:
 			if !ok {
 				log.Debug("close dev to tun", c.LocalAddr(), c.RemoteAddr())
 				return
 			}
 
-			err := c.WriteMessage(websocket.BinaryMessage, message)
+			if !t.opts.Batch {
+				err := t.writeFrame(message, 1)
+				if err != nil {
+					log.Debug("write dev to tun error", err)
+					return
+				}
+				continue
+			}
+
+			// take everything already queued, then hold the frame for
+			// at most BatchDelay waiting for more
+			pending := len(batch) > 0
+			for ok {
+				batch = appendPacket(batch, message)
+				batched++
+				if len(batch) >= vpn.conf.BatchSize {
+					err := sendBatch()
+					if err != nil {
+						log.Debug("write dev to tun error", err)
+						return
+					}
+					pending = false
+				}
+
+				select {
+				case message, ok = <-arpData.Conn:
+				default:
+					ok = false
+				}
+			}
+
+			if len(batch) > 0 && !pending {
+				flush.Reset(vpn.conf.BatchDelay + t.jitter())
+			}
+		case <-flush.C:
+			err := sendBatch()
 			if err != nil {
 				log.Debug("write dev to tun error", err)
 				return
 			}
+		case <-cover:
+			coverTimer.Reset(t.coverInterval() + t.jitter())
+			if time.Since(t.lastWrite) < t.coverInterval() {
+				continue
+			}
+			err := t.writeCover()
+			if err != nil {
+				log.Debug("send cover error", err)
+				return
+			}
 		case <-ticker.C:
 			log.Trace("send ping", c.RemoteAddr())
-			err := c.WriteMessage(websocket.TextMessage, []byte("ping"))
+			err := t.sendPing()
 			if err != nil {
-				log.Debug("send ping error", err)
+				log.Info("send ping error:", err)
+				c.Close()
 				return
 			}
+			if t.opts.Keepalive {
+				log.Debug("tunnel", c.RemoteAddr(), t.stats)
+			}
+		case ts := <-t.pings:
+			err := t.sendPong(ts)
+			if err != nil {
+				log.Debug("send pong error", err)
+				return
+			}
+		case redirect := <-t.goaway:
+			err := sendBatch()
+			if err != nil {
+				log.Debug("write dev to tun error", err)
+				return
+			}
+			vpn.drain(arpData, t, redirect)
+			return
 		}
 
 	}
 }
 
 func (vpn *VPN) handlerCtrC() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+		if vpn.conf.IsServer {
+			// a second signal skips the draining
+			go func() {
+				<-c
+				vpn.stop()
+				os.Exit(1)
+			}()
+			// startServer returns once the sessions are drained
+			vpn.shutdown()
+			return
+		}
 		vpn.stop()
-		os.Exit(1)
+		os.Exit(0)
 	}()
 }
 
@@ -462,9 +991,17 @@ func (vpn *VPN) authenConn(token string) (string, []byte) {
 	return u.IP, keyByte
 }
 
+// isUser reports whether token names a configured user, whatever its key.
+func (vpn *VPN) isUser(token string) bool {
+	arr := strings.Split(token, ":")
+	_, found := vpn.userTable[arr[0]]
+	return len(arr) > 1 && found
+}
+
 func (vpn *VPN) setupAuthentication() {
 	KEY_LEN := 32
 	vpn.userTable = make(map[string]User, 0)
+	vpn.userAddrs = make(map[netip.Addr]string, 0)
 
 	for _, u := range vpn.conf.Users {
 		pass := ""
@@ -472,103 +1009,213 @@ func (vpn *VPN) setupAuthentication() {
 			pass = fmt.Sprintf("%s%s", u.Pass, strings.Repeat("t", KEY_LEN-len(u.Pass)))
 		}
 
+		// the first address is the id of the session
+		var id string
+		for _, addr := range network.SplitAddresses(u.IP) {
+			ip, err := netip.ParseAddr(network.GetIp(addr))
+			if err != nil {
+				continue
+			}
+			ip = ip.Unmap()
+			if len(id) < 1 {
+				id = ip.String()
+			}
+			vpn.userAddrs[ip] = id
+		}
+
 		vpn.userTable[u.Name] = User{
 			Pass: pass,
-			IP:   network.GetIp(u.IP),
+			IP:   id,
 		}
 	}
 }
 
-func (vpn *VPN) setupRoute() error {
-	if YOUR_OS == "linux" {
-		tunCmd := [][]string{
-			{"link", "set", "dev", TUN_NAME, "mtu", fmt.Sprintf("%d", vpn.conf.MTU)},
-			{"addr", "add", vpn.conf.LocalAddr, "dev", TUN_NAME},
-			{"link", "set", "dev", TUN_NAME, "up"},
+// setupWhitelist adds the servers and the proxies to Whitelist, they must
+// stay reachable outside the tunnel, and installs the kill switch before
+// the first connection.
+func (vpn *VPN) setupWhitelist() error {
+	allow := func(ip string) {
+		for _, w := range vpn.conf.Whitelist {
+			if w == ip {
+				return
+			}
 		}
-
-		if !vpn.conf.IsServer {
-			tunCmd = append(tunCmd, [][]string{
-				{"route", "add", "0.0.0.0/1", "dev", TUN_NAME},
-				{"route", "add", "128.0.0.0/1", "dev", TUN_NAME},
-			}...)
+		vpn.conf.Whitelist = append(vpn.conf.Whitelist, ip)
+	}
+	for _, s := range vpn.conf.Servers {
+		addrs, err := vpn.resolveServer(s)
+		if err != nil {
+			log.Error("resolve server error:", err)
 		}
-
-		for _, cmdAgrs := range tunCmd {
-			err := runCmd("/sbin/ip", cmdAgrs...)
+		for _, addr := range addrs {
+			allow(network.GetIp(addr))
+		}
+		if proxyAddr := vpn.proxyAddr(s); len(proxyAddr) > 0 {
+			_, proxyIP, err := utils.ValidServer(proxyAddr)
 			if err != nil {
 				return err
 			}
+			allow(network.GetIp(proxyIP))
 		}
-	} else if YOUR_OS == "windows" && !vpn.conf.IsServer {
-		currentDefaultGateway, err := network.GetDefaultGatewayWindows()
-		if err != nil {
-			return err
+	}
+
+	if !vpn.conf.KillSwitch {
+		return nil
+	}
+
+	// servers are resolved again on every attempt, through the resolvers
+	// of the machine while the tunnel is down
+	resolvers, err := systemResolvers()
+	if err != nil {
+		log.Debug("read resolvers error:", err)
+	}
+	if len(vpn.conf.DNSUpstream) > 0 {
+		resolvers = append(resolvers, network.GetIp(dnsAddr(vpn.conf.DNSUpstream)))
+	}
+	for _, r := range resolvers {
+		if ip := net.ParseIP(r); ip != nil && !ip.IsLoopback() {
+			vpn.resolvers = append(vpn.resolvers, ip.String())
 		}
+	}
+	return vpn.setKillSwitch()
+}
 
-		iface, err := net.InterfaceByName(TUN_NAME)
-		if err != nil {
+// setKillSwitch blocks the traffic outside the tunnel but to Whitelist and
+// the resolvers, while the tunnel is down too, until the client exits.
+func (vpn *VPN) setKillSwitch() error {
+	allow := append(append([]string{}, vpn.conf.Whitelist...), vpn.resolvers...)
+	return vpn.journal.setKillSwitch(TUN_NAME, allow)
+}
+
+func (vpn *VPN) setupRoute() error {
+	if vpn.conf.IsServer && YOUR_OS != "linux" {
+		return fmt.Errorf("not support os: %v", YOUR_OS)
+	}
+
+	err := vpn.routes.SetLink(TUN_NAME, vpn.conf.MTU)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range network.SplitAddresses(vpn.conf.LocalAddr) {
+		err = vpn.journal.addAddress(TUN_NAME, addr)
+		if err != nil && !errors.Is(err, os.ErrExist) {
 			return err
 		}
+	}
 
-		vpn.conf.Whitelist = append(vpn.conf.Whitelist, network.GetIp(vpn.conf.ServerAddr)+"/32")
+	if vpn.conf.IsServer {
+		if vpn.conf.NAT {
+			return vpn.setupNAT()
+		}
+		return nil
+	}
 
-		tunCmd := [][]string{
-			{"netsh", "interface", "ip", "set", "address", fmt.Sprintf("name=%d", iface.Index), "source=static", "addr=" + network.GetIp(vpn.conf.LocalAddr), "mask=" + network.CIDRToMask(vpn.conf.LocalAddr), "gateway=none"},
-			{"route", "add", network.GetIp(vpn.conf.RedirectGateway), "mask", network.CIDRToMask(vpn.conf.RedirectGateway), vpn.conf.DefaultGateway, "if", fmt.Sprintf("%d", iface.Index), "metric", "5"},
-			// {"route", "add", "0.0.0.0", "mask", "0.0.0.0", vpn.conf.DefaultGateway, "if", fmt.Sprintf("%d", iface.Index), "metric", "5"},
-			// {"route", "add", network.GetIp(vpn.conf.ServerAddr), "mask", "255.255.255.255", currentDefaultGateway.Gateway},
+	var routes []network.Route
+	for _, ipW := range vpn.conf.Whitelist {
+		// servers resolve to both families, one may have no gateway here
+		r, err := vpn.bypassRoute(ipW)
+		if err != nil {
+			log.Error("bypass route", ipW, "error:", err)
+			continue
 		}
+		routes = append(routes, r)
+	}
 
-		for _, ipW := range vpn.conf.Whitelist {
-			tunCmd = append(tunCmd, []string{
-				"route", "add", network.GetIp(ipW), "mask", network.CIDRToMask(ipW), currentDefaultGateway.Gateway,
-			})
+	// routes through the tunnel, two halves are more specific than the
+	// default route, which stays untouched
+	var redirect []string
+	for _, dst := range network.SplitAddresses(vpn.conf.RedirectGateway) {
+		switch dst {
+		case "0.0.0.0/0":
+			redirect = append(redirect, "0.0.0.0/1", "128.0.0.0/1")
+		case "::/0":
+			redirect = append(redirect, "::/1", "8000::/1")
+		default:
+			redirect = append(redirect, dst)
+		}
+	}
+	if len(redirect) < 1 {
+		redirect = []string{"0.0.0.0/1", "128.0.0.0/1"}
+		if vpn.hasIPv6() {
+			redirect = append(redirect, "::/1", "8000::/1")
 		}
+	}
+	redirect = append(redirect, vpn.conf.Blacklist...)
+	for _, dst := range redirect {
+		routes = append(routes, vpn.tunnelRoute(dst))
+	}
 
-		for _, ipB := range vpn.conf.Blacklist {
-			tunCmd = append(tunCmd, []string{
-				"route", "add", ipB, "mask", "255.255.255.255", vpn.conf.DefaultGateway, "if", fmt.Sprintf("%d", iface.Index), "metric", "5",
-			})
-			vpn.blackList[ipB] = true
+	for _, r := range routes {
+		err := vpn.addRoute(r)
+		if err != nil {
+			return err
 		}
+	}
 
-		for _, cmdAgrs := range tunCmd {
-			err := runCmd(cmdAgrs[0], cmdAgrs[1:]...)
-			if err != nil {
-				return err
-			}
+	// blacklisted addresses are routed into the tunnel and dropped there
+	for _, ipB := range vpn.conf.Blacklist {
+		err := vpn.classifier.Insert(ipB, network.CLASS_BLOCK)
+		if err != nil {
+			return err
 		}
-	} else {
-		return fmt.Errorf("not support os: %v", YOUR_OS)
 	}
 
+	if vpn.conf.DNSIntercept {
+		return vpn.interceptDNS()
+	}
 	return nil
 }
 
-func (vpn *VPN) stop() {
-	log.Info("Stop vpn ...")
-	if vpn.conf.IsServer {
-	} else {
-		if YOUR_OS == "linux" {
+// bypassRoute is the route sending dst outside the tunnel, through the
+// default gateway of its family.
+func (vpn *VPN) bypassRoute(dst string) (network.Route, error) {
+	gateway, err := vpn.routes.DefaultGateway()
+	if network.IsIPv6(dst) {
+		gateway, err = vpn.routes.DefaultGateway6()
+	}
+	if err != nil {
+		return network.Route{}, err
+	}
+	return network.Route{Dst: dst, Gateway: gateway.Gateway, Interface: gateway.Interface}, nil
+}
 
-		} else if YOUR_OS == "windows" {
-			for _, ipW := range vpn.conf.Whitelist {
-				err := runCmd("route", "delete", network.GetIp(ipW), "mask", network.CIDRToMask(ipW))
-				if err != nil {
-					log.Error(err)
-				}
-			}
+// addRoute adds r and classifies its destination for captureDev.
+func (vpn *VPN) addRoute(r network.Route) error {
+	err := vpn.journal.addRoute(r)
+	if err != nil || r.Table > 0 {
+		return err
+	}
 
-			for _, ipB := range vpn.conf.Blacklist {
-				err := runCmd("route", "delete", ipB)
-				if err != nil {
-					log.Error(err)
-				}
-			}
-			// vpn.dev.Close()
+	class := network.CLASS_BYPASS
+	if r.Interface == TUN_NAME {
+		class = network.CLASS_TUNNEL
+	}
+	return vpn.classifier.Insert(r.Dst, class)
+}
+
+// delRoute deletes a route added by addRoute.
+func (vpn *VPN) delRoute(r network.Route) error {
+	if r.Table < 1 {
+		vpn.classifier.Delete(r.Dst)
+	}
+	return vpn.journal.delRoute(r)
+}
+
+// hasIPv6 reports whether the tunnel carries IPv6.
+func (vpn *VPN) hasIPv6() bool {
+	for _, n := range vpn.myNetworks {
+		if n.IP.To4() == nil {
+			return true
 		}
 	}
+	return false
+}
+
+func (vpn *VPN) stop() {
+	log.Info("Stop vpn ...")
+	vpn.journal.revert()
+	// vpn.dev.Close()
 	log.Info("Done!(GoodBye)")
 	// fmt.Println("Press the Enter Key to exit!")
 	// fmt.Scanln()